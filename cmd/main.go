@@ -1,45 +1,328 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"io/fs"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 
+	"github.com/Polad20/urlshortener/internal/analytics"
 	"github.com/Polad20/urlshortener/internal/auth"
+	"github.com/Polad20/urlshortener/internal/config"
+	"github.com/Polad20/urlshortener/internal/deleter"
 	"github.com/Polad20/urlshortener/internal/handlers"
+	"github.com/Polad20/urlshortener/internal/middleware"
+	"github.com/Polad20/urlshortener/internal/policy"
 	"github.com/Polad20/urlshortener/internal/shortener"
+	"github.com/Polad20/urlshortener/internal/storage"
+	bolt "github.com/Polad20/urlshortener/internal/storage/bolt"
+	cache "github.com/Polad20/urlshortener/internal/storage/cache"
+	file "github.com/Polad20/urlshortener/internal/storage/file"
 	inmem "github.com/Polad20/urlshortener/internal/storage/inmem"
 	pg "github.com/Polad20/urlshortener/internal/storage/pg"
+	redis "github.com/Polad20/urlshortener/internal/storage/redis"
+	"github.com/Polad20/urlshortener/internal/validation"
 	"github.com/joho/godotenv"
 )
 
 func main() {
 
 	err := godotenv.Load(".env")
-	if err != nil {
-		log.Fatal("Error loading .env file, using environment variables or defaults")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Fatalf("Error loading .env file: %v", err)
 	}
 
-	var r *handlers.Handler
-
-	storageType := os.Getenv("REPO")
-	authKey := os.Getenv("KEY")
-	if authKey == "" {
-		log.Fatal("AUTH_SECRET_KEY environment variable not set for authentication middleware")
+	args := os.Args[1:]
+	var migrateArgs []string
+	if len(args) > 0 && args[0] == "migrate" {
+		if len(args) < 2 {
+			log.Fatal(migrateUsage)
+		}
+		migrateArgs, args = args[1:2], args[2:]
 	}
-	authKeyBytes := []byte(authKey)
-	authMiddleware := auth.New(authKeyBytes)
-	newShortener := shortener.NewShortener()
-	switch storageType {
+	cfg, err := config.Load(args, os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if migrateArgs != nil {
+		if err := runMigrate(cfg.PGURL, migrateArgs); err != nil {
+			log.Fatalf("Migration error: %v", err)
+		}
+		return
+	}
+
+	var repo storage.Storage
+	var keys auth.KeyStore
+	var seq shortener.Sequence
+	var boltRepo *bolt.Storage
+	switch cfg.Repo {
 	case "in-memory":
-		repo := inmem.NewInmem()
-		r = handlers.NewHandler(repo, newShortener, authMiddleware)
+		repo = inmem.NewInmem()
+	case "file":
+		fileRepo, err := file.Open(cfg.FileStoragePath, file.Options{
+			Sync:            file.SyncPolicy(cfg.FileSync),
+			SyncInterval:    cfg.FileSyncInterval,
+			CompactInterval: cfg.FileCompactInterval,
+		})
+		if err != nil {
+			log.Fatalf("Error opening file storage: %v", err)
+		}
+		repo = fileRepo
+		seq = fileRepo
+	case "bolt":
+		boltRepo, err = bolt.Open(cfg.BoltPath)
+		if err != nil {
+			log.Fatalf("Error opening bolt storage: %v", err)
+		}
+		repo = boltRepo
+		seq = boltRepo
+	case "redis":
+		redisRepo, err := redis.NewRedisStorage(cfg.RedisURL)
+		if err != nil {
+			log.Fatalf("Error connecting to redis storage: %v", err)
+		}
+		repo = redisRepo
+		seq = redisRepo
 	case "postgres":
-		repo, err := pg.NewPostgresStorage()
+		pgRepo, err := pg.NewPostgresStorage(cfg.PGURL)
+		if err != nil {
+			log.Fatalf("Ошибка создания нового экземпляра PostgresStorage: %v", err)
+		}
+		repo = pgRepo
+		seq = pgRepo
+		keys = pgRepo
+	}
+	if keys == nil && cfg.APIKeysFile != "" {
+		keys, err = auth.OpenKeyFile(cfg.APIKeysFile)
+		if err != nil {
+			log.Fatalf("Error opening API key file: %v", err)
+		}
+	} else if keys == nil {
+		keys = auth.NewMemoryKeyStore()
+	}
+	authMiddleware := auth.New([]byte(cfg.AuthKey), keys)
+	repo = storage.WithTimeouts(repo, storage.Timeouts{
+		Redirect: cfg.StorageRedirectTimeout,
+		Read:     cfg.StorageReadTimeout,
+		Write:    cfg.StorageWriteTimeout,
+		Stats:    cfg.StorageStatsTimeout,
+		Ping:     cfg.StoragePingTimeout,
+	})
+	if cfg.RedisCache {
+		cacheClient, err := redis.Connect(cfg.RedisURL)
+		if err != nil {
+			log.Fatalf("Error connecting to redis cache: %v", err)
+		}
+		repo = redis.NewCache(repo, cacheClient, cfg.RedisCacheTTL)
+	}
+	var redirectCache *cache.Cache
+	if cfg.CacheSize > 0 {
+		redirectCache = cache.New(repo, cache.Options{
+			Size:        cfg.CacheSize,
+			TTL:         cfg.CacheTTL,
+			NegativeTTL: cfg.CacheNegativeTTL,
+		})
+		repo = redirectCache
+	}
+	newShortener, err := shortener.NewShortener(shortener.Options{
+		Strategy:    cfg.Generator,
+		Charset:     cfg.Charset,
+		Length:      cfg.Length,
+		HashidsSalt: cfg.HashidsSalt,
+	}, seq)
+	if err != nil {
+		log.Fatalf("Error creating shortener: %v", err)
+	}
+	domain, err := url.Parse(cfg.Domain)
+	if err != nil {
+		log.Fatalf("Error parsing DOMAIN: %v", err)
+	}
+	validationOpts := validation.Options{
+		Schemes:       strings.Split(cfg.URLSchemes, ","),
+		MaxLength:     cfg.URLMaxLength,
+		TrailingSlash: cfg.URLTrailingSlash,
+		SortQuery:     cfg.URLSortQuery,
+		BlockPrivate:  cfg.URLBlockPrivate,
+		OwnHosts:      []string{domain.Hostname()},
+		Shorteners:    strings.Split(cfg.URLShorteners, ","),
+	}
+	if cfg.URLResolveHosts {
+		validationOpts.Resolver = net.DefaultResolver
+	}
+	validator, err := validation.New(validationOpts)
+	if err != nil {
+		log.Fatalf("Error creating URL validator: %v", err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	backgroundCtx, stopBackground := context.WithCancel(context.Background())
+	var background sync.WaitGroup
+	if reaper, ok := repo.(storage.Reaper); ok {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			storage.RunReaper(backgroundCtx, reaper, cfg.ReapInterval)
+		}()
+	}
+	if boltRepo != nil && cfg.BoltBackupDir != "" {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			bolt.RunBackups(backgroundCtx, boltRepo, cfg.BoltBackupDir, cfg.BoltBackupInterval)
+		}()
+	}
+	var destinations policy.Chain
+	if cfg.PolicyFile != "" {
+		rules, err := policy.LoadFileRules(cfg.PolicyFile)
+		if err != nil {
+			log.Fatalf("Error loading destination policy: %v", err)
+		}
+		destinations = append(destinations, rules)
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			rules.Watch(backgroundCtx, cfg.PolicyReloadInterval)
+		}()
+	}
+	if cfg.PolicyHashFile != "" {
+		db, err := policy.LoadHashFile(cfg.PolicyHashFile)
+		if err != nil {
+			log.Fatalf("Error loading unsafe URL hashes: %v", err)
+		}
+		destinations = append(destinations, policy.HashPrefixChecker{DB: db, Action: policy.Block, Name: cfg.PolicyHashFile})
+	}
+	recorder := analytics.NewRecorder(repo, cfg.ClickBufferSize, cfg.ClickBatchSize, cfg.ClickFlushInterval)
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		recorder.Run(backgroundCtx)
+	}()
+	deletePool := deleter.NewPool(repo, cfg.DeleteWorkers, cfg.DeleteQueueSize, cfg.DeleteBatchSize, cfg.DeleteFlushInterval)
+	deletePool.Start()
+	limits, err := rateLimits(cfg)
+	if err != nil {
+		log.Fatalf("Error creating rate limits: %v", err)
+	}
+	r := handlers.NewHandler(repo, newShortener, validator, authMiddleware, recorder, deletePool, handlers.Links{
+		BaseURL:            cfg.Domain,
+		TrustForwardedHost: cfg.TrustForwardedHost,
+	}, handlers.Destinations{
+		Checker:      destinations,
+		Interstitial: cfg.PolicyInterstitial,
+	}, limits)
+
+	srv := &http.Server{
+		Addr:    cfg.ServerAddress,
+		Handler: r,
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		log.Printf("Listening on %s", srv.Addr)
+		serveErr <- srv.ListenAndServe()
+	}()
+	select {
+	case err := <-serveErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("HTTP server error: %v", err)
+		}
+	case <-ctx.Done():
+		log.Printf("Shutdown signal received, draining")
+	}
+	stop()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	shutdown(shutdownCtx, srv, deletePool, stopBackground, &background, repo)
+	if redirectCache != nil {
+		stats := redirectCache.Stats()
+		log.Printf("Redirect cache: %d hits, %d misses", stats.Hits, stats.Misses)
+	}
+}
+
+// shutdown stops components in dependency order: first the HTTP server so no
+// new work arrives, then the delete pool, reaper and click recorder which all
+// write to storage, and storage itself last.
+func shutdown(ctx context.Context, srv *http.Server, deletePool *deleter.Pool, stopBackground context.CancelFunc, background *sync.WaitGroup, repo storage.Storage) {
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Error shutting down HTTP server: %v", err)
+	}
+	if err := deletePool.Close(ctx); err != nil {
+		log.Printf("Error draining delete pool: %v", err)
+	}
+	stopBackground()
+	done := make(chan struct{})
+	go func() {
+		background.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Printf("Timed out waiting for background workers: %v", ctx.Err())
+	}
+	if err := repo.Close(); err != nil {
+		log.Printf("Error closing storage: %v", err)
+	}
+	log.Printf("Shutdown complete")
+}
+
+// rateLimits builds the limiters of the route groups. Redirects carry no
+// user, so they are always counted by address.
+func rateLimits(cfg *config.Config) (handlers.Limits, error) {
+	var limits handlers.Limits
+	if cfg.RateLimitShorten == 0 && cfg.RateLimitBatch == 0 && cfg.RateLimitRedirect == 0 {
+		return limits, nil
+	}
+	var store middleware.Store = middleware.NewMemoryStore()
+	if cfg.RateLimitBackend == "redis" {
+		client, err := redis.Connect(cfg.RedisURL)
+		if err != nil {
+			return limits, err
+		}
+		store = middleware.NewRedisStore(client)
+	}
+	byIP := middleware.ByIP(cfg.RateLimitTrustProxy)
+	var keys []middleware.KeyFunc
+	for _, key := range strings.Split(cfg.RateLimitKey, ",") {
+		switch key {
+		case "user":
+			// Requests without a user identity are counted by address.
+			keys = append(keys, middleware.FirstOf(middleware.ByUser, byIP))
+		case "ip":
+			keys = append(keys, byIP)
+		}
+	}
+	for _, l := range []struct {
+		name  string
+		limit int
+		keys  []middleware.KeyFunc
+		mw    *func(http.Handler) http.Handler
+	}{
+		{"shorten", cfg.RateLimitShorten, keys, &limits.Shorten},
+		{"batch", cfg.RateLimitBatch, keys, &limits.Batch},
+		{"redirect", cfg.RateLimitRedirect, []middleware.KeyFunc{byIP}, &limits.Redirect},
+	} {
+		if l.limit == 0 {
+			continue
+		}
+		limiter, err := middleware.NewRateLimiter(store, l.name, middleware.Rate{Limit: l.limit, Period: cfg.RateLimitWindow}, l.keys...)
 		if err != nil {
-			log.Fatal("Ошибка создания нового экземпляра PostgresStorage")
+			return limits, err
 		}
-		r = handlers.NewHandler(repo, newShortener, authMiddleware)
+		*l.mw = limiter.Middleware
 	}
-	log.Fatal(http.ListenAndServe(":8080", r))
+	return limits, nil
 }
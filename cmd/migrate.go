@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	pg "github.com/Polad20/urlshortener/internal/storage/pg"
+)
+
+const migrateUsage = "usage: urlshortener migrate up|down|status [flags]"
+
+func runMigrate(dsn string, args []string) error {
+	if len(args) != 1 {
+		return errors.New(migrateUsage)
+	}
+	if dsn == "" {
+		return errors.New("PG_URL is required for migrations")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return fmt.Errorf("error opening DB: %w", err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+	switch args[0] {
+	case "up":
+		return pg.MigrateUp(ctx, db)
+	case "down":
+		return pg.MigrateDown(ctx, db)
+	case "status":
+		statuses, err := pg.MigrationsStatus(ctx, db)
+		if err != nil {
+			return err
+		}
+		for _, s := range statuses {
+			state := "pending"
+			if s.Applied {
+				state = "applied " + s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d_%s\t%s\n", s.Version, s.Name, state)
+		}
+		return nil
+	default:
+		return errors.New(migrateUsage)
+	}
+}
@@ -0,0 +1,128 @@
+package analytics
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/Polad20/urlshortener/internal/model"
+)
+
+// ClickWriter is the part of storage.Storage the recorder needs.
+type ClickWriter interface {
+	SaveClicks(ctx context.Context, clicks []model.Click) error
+}
+
+// Recorder buffers clicks in memory and writes them to storage in batches,
+// so that redirects never wait for the analytics write.
+type Recorder struct {
+	writer        ClickWriter
+	clicks        chan model.Click
+	batchSize     int
+	flushInterval time.Duration
+	dropped       atomic.Int64
+}
+
+func NewRecorder(writer ClickWriter, bufferSize, batchSize int, flushInterval time.Duration) *Recorder {
+	return &Recorder{
+		writer:        writer,
+		clicks:        make(chan model.Click, bufferSize),
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+	}
+}
+
+// Record queues a click without blocking. When the buffer is full the click
+// is dropped and counted, and false is returned.
+func (r *Recorder) Record(click model.Click) bool {
+	select {
+	case r.clicks <- click:
+		return true
+	default:
+		r.dropped.Add(1)
+		return false
+	}
+}
+
+func (r *Recorder) Dropped() int64 {
+	return r.dropped.Load()
+}
+
+// Run writes queued clicks until ctx is cancelled, then flushes whatever is
+// still buffered and returns.
+func (r *Recorder) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.flushInterval)
+	defer ticker.Stop()
+	batch := make([]model.Click, 0, r.batchSize)
+	for {
+		select {
+		case click := <-r.clicks:
+			batch = append(batch, click)
+			if len(batch) >= r.batchSize {
+				batch = r.flush(ctx, batch)
+			}
+		case <-ticker.C:
+			batch = r.flush(ctx, batch)
+		case <-ctx.Done():
+			r.drain(batch)
+			return
+		}
+	}
+}
+
+func (r *Recorder) drain(batch []model.Click) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for {
+		select {
+		case click := <-r.clicks:
+			batch = append(batch, click)
+			if len(batch) >= r.batchSize {
+				batch = r.flush(ctx, batch)
+			}
+		default:
+			r.flush(ctx, batch)
+			return
+		}
+	}
+}
+
+func (r *Recorder) flush(ctx context.Context, batch []model.Click) []model.Click {
+	if len(batch) == 0 {
+		return batch
+	}
+	if err := r.writer.SaveClicks(ctx, batch); err != nil {
+		log.Printf("Error saving %d clicks: %v", len(batch), err)
+	}
+	return batch[:0]
+}
+
+// NewClick describes a redirect of shortURL served for req. The client IP is
+// coarsened to its /24 (IPv4) or /48 (IPv6) network.
+func NewClick(shortURL string, req *http.Request, now time.Time) model.Click {
+	return model.Click{
+		ShortURL:  shortURL,
+		Timestamp: now,
+		Referrer:  req.Referer(),
+		UserAgent: req.UserAgent(),
+		ClientIP:  CoarseIP(req.RemoteAddr),
+	}
+}
+
+func CoarseIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
@@ -0,0 +1,59 @@
+package analytics
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Polad20/urlshortener/internal/model"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeWriter struct {
+	lock    sync.Mutex
+	batches [][]model.Click
+}
+
+func (f *fakeWriter) SaveClicks(ctx context.Context, clicks []model.Click) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.batches = append(f.batches, append([]model.Click(nil), clicks...))
+	return nil
+}
+
+func (f *fakeWriter) total() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	n := 0
+	for _, b := range f.batches {
+		n += len(b)
+	}
+	return n
+}
+
+func TestRecorder(t *testing.T) {
+	w := &fakeWriter{}
+	r := NewRecorder(w, 3, 2, time.Hour)
+	for i := 0; i < 4; i++ {
+		r.Record(model.Click{ShortURL: "abc"})
+	}
+	assert.Equal(t, int64(1), r.Dropped(), "clicks over the buffer size should be dropped")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		r.Run(ctx)
+		close(done)
+	}()
+	assert.Eventually(t, func() bool { return w.total() == 2 }, time.Second, time.Millisecond, "full batches are written without waiting for the ticker")
+	cancel()
+	<-done
+	assert.Equal(t, 3, w.total(), "remaining clicks are flushed on shutdown")
+}
+
+func TestCoarseIP(t *testing.T) {
+	assert.Equal(t, "192.168.10.0", CoarseIP("192.168.10.77:5000"))
+	assert.Equal(t, "2001:db8:abcd::", CoarseIP("[2001:db8:abcd:12::1]:443"))
+	assert.Equal(t, "", CoarseIP("not-an-ip"))
+}
@@ -5,8 +5,11 @@ import (
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -14,13 +17,23 @@ import (
 	"time"
 )
 
+// lastUsedResolution is how stale the last-used time of a key may get
+// before a request updates it, so that busy keys are not written every time.
+const lastUsedResolution = time.Minute
+
 type Auth struct {
-	key []byte
+	key  []byte
+	keys KeyStore
+	now  func() time.Time
 }
 
-func New(key []byte) *Auth {
+// New returns the auth middleware. Without a key store only cookie
+// sessions are accepted.
+func New(key []byte, keys KeyStore) *Auth {
 	return &Auth{
-		key: key,
+		key:  key,
+		keys: keys,
+		now:  time.Now,
 	}
 }
 
@@ -60,6 +73,10 @@ func generateRandom(n int) ([]byte, error) {
 
 func (a *Auth) MiddlewareAuth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if header := r.Header.Get("Authorization"); header != "" {
+			a.bearer(w, r, next, header)
+			return
+		}
 		cookie, err := r.Cookie("userID")
 		if err == http.ErrNoCookie {
 			userID, err := generateRandom(32)
@@ -108,3 +125,130 @@ func (a *Auth) MiddlewareAuth(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+// bearer authenticates a request by API key. Such requests get the user ID
+// of the key owner and the scopes of the key in their context.
+func (a *Auth) bearer(w http.ResponseWriter, r *http.Request, next http.Handler, header string) {
+	scheme, token, _ := strings.Cut(header, " ")
+	if !strings.EqualFold(scheme, "Bearer") || a.keys == nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	key, err := a.authenticate(r.Context(), strings.TrimSpace(token))
+	if err != nil {
+		if !errors.Is(err, ErrKeyNotFound) {
+			log.Printf("Error checking API key: %v", err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if now := a.now(); key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) >= lastUsedResolution {
+		if err := a.keys.TouchKey(r.Context(), key.ID, now); err != nil {
+			log.Printf("Error updating last use of API key %s: %v", key.ID, err)
+		}
+	}
+	ctx := context.WithValue(r.Context(), "userID", key.UserID)
+	ctx = context.WithValue(ctx, "scopes", key.Scopes)
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// authenticate returns the live key of token, or ErrKeyNotFound for
+// unknown, mistyped and revoked keys alike.
+func (a *Auth) authenticate(ctx context.Context, token string) (APIKey, error) {
+	id, ok := parseToken(token)
+	if !ok {
+		return APIKey{}, ErrKeyNotFound
+	}
+	key, err := a.keys.FindKey(ctx, id)
+	if err != nil {
+		return APIKey{}, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(key.Hash)) != 1 || key.RevokedAt != nil {
+		return APIKey{}, ErrKeyNotFound
+	}
+	return key, nil
+}
+
+// HasScope reports whether the request may use scope: cookie sessions may
+// do everything, API keys only what their scopes allow.
+func HasScope(ctx context.Context, scope string) bool {
+	scopes, ok := ctx.Value("scopes").([]string)
+	if !ok {
+		return true
+	}
+	return APIKey{Scopes: scopes}.HasScope(scope)
+}
+
+// RequireScope refuses requests whose API key lacks scope with a 403
+// problem document naming the scope.
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !HasScope(r.Context(), scope) {
+				log.Printf("API key lacks scope %s", scope)
+				w.Header().Set("Content-Type", "application/problem+json")
+				w.WriteHeader(http.StatusForbidden)
+				json.NewEncoder(w).Encode(map[string]any{
+					"type":     "about:blank",
+					"title":    http.StatusText(http.StatusForbidden),
+					"status":   http.StatusForbidden,
+					"detail":   fmt.Sprintf("API key lacks scope %q", scope),
+					"instance": r.URL.Path,
+				})
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// CreateKey creates a key of userID and returns it with its token, which
+// is not stored anywhere and cannot be shown again.
+func (a *Auth) CreateKey(ctx context.Context, userID, name string, scopes []string) (APIKey, string, error) {
+	if a.keys == nil {
+		return APIKey{}, "", errKeysDisabled
+	}
+	scopes, err := normalizeScopes(scopes)
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	id, err := generateRandom(8)
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	secret, err := generateRandom(32)
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	key := APIKey{
+		ID:        hex.EncodeToString(id),
+		UserID:    userID,
+		Name:      name,
+		Scopes:    scopes,
+		CreatedAt: a.now().UTC(),
+	}
+	token := keyPrefix + key.ID + "_" + base64.RawURLEncoding.EncodeToString(secret)
+	key.Hash = hashToken(token)
+	if err := a.keys.CreateKey(ctx, key); err != nil {
+		return APIKey{}, "", err
+	}
+	return key, token, nil
+}
+
+func (a *Auth) ListKeys(ctx context.Context, userID string) ([]APIKey, error) {
+	if a.keys == nil {
+		return nil, errKeysDisabled
+	}
+	return a.keys.ListKeys(ctx, userID)
+}
+
+func (a *Auth) RevokeKey(ctx context.Context, userID, id string) error {
+	if a.keys == nil {
+		return errKeysDisabled
+	}
+	return a.keys.RevokeKey(ctx, userID, id, a.now().UTC())
+}
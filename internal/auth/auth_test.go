@@ -0,0 +1,34 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequireScope(t *testing.T) {
+	handler := RequireScope(ScopeShorten)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/api/shorten", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNoContent, rec.Code, "cookie sessions may do everything")
+
+	ctx := context.WithValue(req.Context(), "scopes", []string{ScopeRead})
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req.WithContext(ctx))
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Equal(t, "application/problem+json", rec.Header().Get("Content-Type"))
+	var problem map[string]any
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &problem))
+	assert.Equal(t, float64(http.StatusForbidden), problem["status"])
+	assert.Equal(t, `API key lacks scope "shorten"`, problem["detail"])
+	assert.Equal(t, "/api/shorten", problem["instance"])
+}
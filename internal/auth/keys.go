@@ -0,0 +1,248 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Polad20/urlshortener/internal/storage"
+)
+
+// Scopes limit what an API key may do. Cookie sessions have all of them.
+const (
+	ScopeShorten = "shorten"
+	ScopeRead    = "read"
+	ScopeDelete  = "delete"
+	ScopeKeys    = "keys"
+)
+
+var knownScopes = map[string]bool{ScopeShorten: true, ScopeRead: true, ScopeDelete: true, ScopeKeys: true}
+
+// DefaultScopes are given to keys created without explicit scopes.
+var DefaultScopes = []string{ScopeShorten, ScopeRead}
+
+var (
+	ErrKeyNotFound  = fmt.Errorf("API key not found: %w", storage.ErrNotFound)
+	ErrUnknownScope = errors.New("unknown scope")
+	errKeysDisabled = errors.New("API keys are not configured")
+)
+
+// keyPrefix starts every token, so that leaked keys are easy to grep for.
+const keyPrefix = "usk_"
+
+// APIKey is a stored key. Only the SHA-256 of the token is kept; the token
+// itself is shown once, when the key is created.
+type APIKey struct {
+	ID         string     `json:"id"`
+	UserID     string     `json:"user_id"`
+	Name       string     `json:"name,omitempty"`
+	Hash       string     `json:"hash"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+func (k APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// KeyStore keeps API keys. RevokeKey returns ErrKeyNotFound for keys of
+// other users; revoking a revoked key is not an error.
+type KeyStore interface {
+	CreateKey(ctx context.Context, key APIKey) error
+	FindKey(ctx context.Context, id string) (APIKey, error)
+	ListKeys(ctx context.Context, userID string) ([]APIKey, error)
+	RevokeKey(ctx context.Context, userID, id string, at time.Time) error
+	TouchKey(ctx context.Context, id string, at time.Time) error
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseToken returns the key ID of a usk_<id>_<secret> token.
+func parseToken(token string) (string, bool) {
+	rest, ok := strings.CutPrefix(token, keyPrefix)
+	if !ok {
+		return "", false
+	}
+	id, secret, ok := strings.Cut(rest, "_")
+	return id, ok && id != "" && secret != ""
+}
+
+func normalizeScopes(scopes []string) ([]string, error) {
+	if len(scopes) == 0 {
+		return append([]string(nil), DefaultScopes...), nil
+	}
+	seen := make(map[string]bool, len(scopes))
+	var result []string
+	for _, s := range scopes {
+		if !knownScopes[s] {
+			return nil, fmt.Errorf("%w %q", ErrUnknownScope, s)
+		}
+		if !seen[s] {
+			seen[s] = true
+			result = append(result, s)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// MemoryKeyStore keeps keys in memory and, when opened with OpenKeyFile,
+// rewrites the whole file on every change.
+type MemoryKeyStore struct {
+	mu   sync.RWMutex
+	keys map[string]APIKey
+	path string
+}
+
+func NewMemoryKeyStore() *MemoryKeyStore {
+	return &MemoryKeyStore{keys: make(map[string]APIKey)}
+}
+
+// OpenKeyFile loads the keys saved in path, which need not exist yet.
+func OpenKeyFile(path string) (*MemoryKeyStore, error) {
+	s := NewMemoryKeyStore()
+	s.path = path
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var keys []APIKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("key file %s: %w", path, err)
+	}
+	for _, k := range keys {
+		s.keys[k.ID] = k
+	}
+	return s, nil
+}
+
+func (s *MemoryKeyStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	keys := make([]APIKey, 0, len(s.keys))
+	for _, k := range s.keys {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+func (s *MemoryKeyStore) CreateKey(ctx context.Context, key APIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.keys[key.ID]; ok {
+		return fmt.Errorf("API key %s: %w", key.ID, storage.ErrConflict)
+	}
+	key.Scopes = append([]string(nil), key.Scopes...)
+	s.keys[key.ID] = key
+	if err := s.save(); err != nil {
+		delete(s.keys, key.ID)
+		return err
+	}
+	return nil
+}
+
+func (s *MemoryKeyStore) FindKey(ctx context.Context, id string) (APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	key, ok := s.keys[id]
+	if !ok {
+		return APIKey{}, ErrKeyNotFound
+	}
+	key.Scopes = append([]string(nil), key.Scopes...)
+	return key, nil
+}
+
+func (s *MemoryKeyStore) ListKeys(ctx context.Context, userID string) ([]APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var keys []APIKey
+	for _, k := range s.keys {
+		if k.UserID == userID {
+			k.Scopes = append([]string(nil), k.Scopes...)
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys, nil
+}
+
+func (s *MemoryKeyStore) RevokeKey(ctx context.Context, userID, id string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, ok := s.keys[id]
+	if !ok || key.UserID != userID {
+		return ErrKeyNotFound
+	}
+	if key.RevokedAt != nil {
+		return nil
+	}
+	revoked := key
+	revoked.RevokedAt = &at
+	s.keys[id] = revoked
+	if err := s.save(); err != nil {
+		s.keys[id] = key
+		return err
+	}
+	return nil
+}
+
+func (s *MemoryKeyStore) TouchKey(ctx context.Context, id string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, ok := s.keys[id]
+	if !ok {
+		return ErrKeyNotFound
+	}
+	touched := key
+	touched.LastUsedAt = &at
+	s.keys[id] = touched
+	if err := s.save(); err != nil {
+		s.keys[id] = key
+		return err
+	}
+	return nil
+}
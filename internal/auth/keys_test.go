@@ -0,0 +1,71 @@
+package auth
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyFile(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "keys.json")
+	store, err := OpenKeyFile(path)
+	require.NoError(t, err)
+	a := New([]byte("secret"), store)
+
+	key, token, err := a.CreateKey(ctx, "user1", "ci", []string{ScopeRead, ScopeShorten, ScopeRead})
+	require.NoError(t, err)
+	assert.Equal(t, []string{ScopeRead, ScopeShorten}, key.Scopes)
+	assert.NotContains(t, key.Hash, token)
+	_, _, err = a.CreateKey(ctx, "user1", "", []string{"admin"})
+	assert.ErrorIs(t, err, ErrUnknownScope)
+
+	used := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.NoError(t, store.TouchKey(ctx, key.ID, used))
+
+	reopened, err := OpenKeyFile(path)
+	require.NoError(t, err)
+	a = New([]byte("secret"), reopened)
+	found, err := a.authenticate(ctx, token)
+	require.NoError(t, err)
+	assert.Equal(t, "user1", found.UserID)
+	require.NotNil(t, found.LastUsedAt)
+	assert.True(t, used.Equal(*found.LastUsedAt))
+
+	_, err = a.authenticate(ctx, token+"x")
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	_, err = a.authenticate(ctx, "not-a-key")
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+
+	assert.ErrorIs(t, a.RevokeKey(ctx, "user2", key.ID), ErrKeyNotFound)
+	require.NoError(t, a.RevokeKey(ctx, "user1", key.ID))
+	require.NoError(t, a.RevokeKey(ctx, "user1", key.ID))
+	_, err = a.authenticate(ctx, token)
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+
+	keys, err := a.ListKeys(ctx, "user1")
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	assert.NotNil(t, keys[0].RevokedAt)
+}
+
+func TestKeyFileSaveFailure(t *testing.T) {
+	ctx := context.Background()
+	store, err := OpenKeyFile(filepath.Join(t.TempDir(), "keys.json"))
+	require.NoError(t, err)
+	require.NoError(t, store.CreateKey(ctx, APIKey{ID: "k1", UserID: "user1", Scopes: DefaultScopes}))
+	// Saving fails from now on.
+	store.path = filepath.Join(t.TempDir(), "missing", "keys.json")
+
+	at := time.Now()
+	assert.Error(t, store.RevokeKey(ctx, "user1", "k1", at))
+	assert.Error(t, store.TouchKey(ctx, "k1", at))
+	key, err := store.FindKey(ctx, "k1")
+	require.NoError(t, err)
+	assert.Nil(t, key.RevokedAt, "a revocation that was not saved is undone")
+	assert.Nil(t, key.LastUsedAt, "a use that was not saved is undone")
+}
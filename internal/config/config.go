@@ -0,0 +1,554 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds every setting of the service. Values are resolved with the
+// following precedence, highest first:
+//
+//  1. command line flags (-server-address, -pg-url, ...)
+//  2. environment variables (SERVER_ADDRESS, PG_URL, ...)
+//  3. the YAML file named by -config or CONFIG (server_address, pg_url, ...)
+//  4. built-in defaults
+//
+// Flag, env and file keys are derived from the same name, see fields.
+type Config struct {
+	ServerAddress   string
+	ShutdownTimeout time.Duration
+
+	Domain             string
+	TrustForwardedHost bool
+	Length             int
+	Charset            string
+	Generator          string
+	HashidsSalt        string
+
+	Repo         string
+	PGURL        string
+	ReapInterval time.Duration
+
+	StorageRedirectTimeout time.Duration
+	StorageReadTimeout     time.Duration
+	StorageWriteTimeout    time.Duration
+	StorageStatsTimeout    time.Duration
+	StoragePingTimeout     time.Duration
+
+	FileStoragePath     string
+	FileSync            string
+	FileSyncInterval    time.Duration
+	FileCompactInterval time.Duration
+
+	BoltPath           string
+	BoltBackupDir      string
+	BoltBackupInterval time.Duration
+
+	RedisURL      string
+	RedisCache    bool
+	RedisCacheTTL time.Duration
+
+	CacheSize        int
+	CacheTTL         time.Duration
+	CacheNegativeTTL time.Duration
+
+	RateLimitShorten    int
+	RateLimitBatch      int
+	RateLimitRedirect   int
+	RateLimitWindow     time.Duration
+	RateLimitKey        string
+	RateLimitTrustProxy bool
+	RateLimitBackend    string
+
+	URLSchemes       string
+	URLMaxLength     int
+	URLTrailingSlash string
+	URLSortQuery     bool
+	URLBlockPrivate  bool
+	URLResolveHosts  bool
+	URLShorteners    string
+
+	PolicyFile           string
+	PolicyReloadInterval time.Duration
+	PolicyHashFile       string
+	PolicyInterstitial   bool
+
+	AuthKey     string
+	APIKeysFile string
+
+	ClickBufferSize    int
+	ClickBatchSize     int
+	ClickFlushInterval time.Duration
+
+	DeleteWorkers       int
+	DeleteQueueSize     int
+	DeleteBatchSize     int
+	DeleteFlushInterval time.Duration
+}
+
+func Default() Config {
+	return Config{
+		ServerAddress:          ":8080",
+		ShutdownTimeout:        15 * time.Second,
+		Domain:                 "http://localhost:8080/",
+		Length:                 10,
+		Charset:                "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_",
+		Generator:              "random",
+		URLSchemes:             "http,https",
+		URLMaxLength:           2048,
+		URLTrailingSlash:       "keep",
+		URLSortQuery:           true,
+		URLBlockPrivate:        true,
+		URLResolveHosts:        true,
+		URLShorteners:          "bit.ly,t.co,tinyurl.com,goo.gl,ow.ly,is.gd,buff.ly,rebrand.ly,cutt.ly,shorturl.at",
+		PolicyReloadInterval:   10 * time.Second,
+		Repo:                   "in-memory",
+		ReapInterval:           time.Minute,
+		StorageRedirectTimeout: time.Second,
+		StorageReadTimeout:     3 * time.Second,
+		StorageWriteTimeout:    5 * time.Second,
+		StorageStatsTimeout:    10 * time.Second,
+		StoragePingTimeout:     time.Second,
+		FileStoragePath:        "urls.jsonl",
+		FileSync:               "interval",
+		FileSyncInterval:       time.Second,
+		FileCompactInterval:    time.Hour,
+		BoltPath:               "urls.db",
+		BoltBackupInterval:     time.Hour,
+		RedisCacheTTL:          time.Minute,
+		CacheSize:              10000,
+		CacheTTL:               time.Minute,
+		CacheNegativeTTL:       10 * time.Second,
+		RateLimitShorten:       60,
+		RateLimitBatch:         10,
+		RateLimitWindow:        time.Minute,
+		RateLimitKey:           "user,ip",
+		RateLimitBackend:       "memory",
+		ClickBufferSize:        10000,
+		ClickBatchSize:         500,
+		ClickFlushInterval:     time.Second,
+		DeleteWorkers:          4,
+		DeleteQueueSize:        1000,
+		DeleteBatchSize:        500,
+		DeleteFlushInterval:    time.Second,
+	}
+}
+
+type field struct {
+	// name is the environment variable; the flag is its lower-case form with
+	// dashes and the YAML key its lower-case form.
+	name  string
+	usage string
+	set   func(c *Config, v string) error
+}
+
+func (f field) flagName() string {
+	return strings.ReplaceAll(strings.ToLower(f.name), "_", "-")
+}
+
+func (f field) fileKey() string {
+	return strings.ToLower(f.name)
+}
+
+func stringField(name, usage string, dst func(c *Config) *string) field {
+	return field{name: name, usage: usage, set: func(c *Config, v string) error {
+		*dst(c) = v
+		return nil
+	}}
+}
+
+func intField(name, usage string, dst func(c *Config) *int) field {
+	return field{name: name, usage: usage, set: func(c *Config, v string) error {
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return fmt.Errorf("%s must be a whole number, got %q", name, v)
+		}
+		*dst(c) = n
+		return nil
+	}}
+}
+
+func boolField(name, usage string, dst func(c *Config) *bool) field {
+	return field{name: name, usage: usage, set: func(c *Config, v string) error {
+		b, err := strconv.ParseBool(strings.TrimSpace(v))
+		if err != nil {
+			return fmt.Errorf("%s must be true or false, got %q", name, v)
+		}
+		*dst(c) = b
+		return nil
+	}}
+}
+
+func durationField(name, usage string, dst func(c *Config) *time.Duration) field {
+	return field{name: name, usage: usage, set: func(c *Config, v string) error {
+		d, err := time.ParseDuration(strings.TrimSpace(v))
+		if err != nil {
+			return fmt.Errorf("%s must be a duration like 30s or 5m, got %q", name, v)
+		}
+		*dst(c) = d
+		return nil
+	}}
+}
+
+var fields = []field{
+	stringField("SERVER_ADDRESS", "address the HTTP server listens on", func(c *Config) *string { return &c.ServerAddress }),
+	durationField("SHUTDOWN_TIMEOUT", "how long to drain requests and workers on shutdown", func(c *Config) *time.Duration { return &c.ShutdownTimeout }),
+	stringField("DOMAIN", "public base URL prepended to short codes", func(c *Config) *string { return &c.Domain }),
+	boolField("TRUST_FORWARDED_HOST", "build short URLs from X-Forwarded-Host when present", func(c *Config) *bool { return &c.TrustForwardedHost }),
+	intField("LENGTH", "number of characters in generated short codes", func(c *Config) *int { return &c.Length }),
+	stringField("CHARSET", "characters used in short codes and aliases", func(c *Config) *string { return &c.Charset }),
+	stringField("GENERATOR", "short code strategy: random, counter, hashids or hash", func(c *Config) *string { return &c.Generator }),
+	stringField("HASHIDS_SALT", "salt for the hashids strategy", func(c *Config) *string { return &c.HashidsSalt }),
+	stringField("URL_SCHEMES", "comma-separated schemes allowed in shortened URLs", func(c *Config) *string { return &c.URLSchemes }),
+	intField("URL_MAX_LENGTH", "maximum length of a shortened URL", func(c *Config) *int { return &c.URLMaxLength }),
+	stringField("URL_TRAILING_SLASH", "trailing slash rule for shortened URLs: keep or strip", func(c *Config) *string { return &c.URLTrailingSlash }),
+	boolField("URL_SORT_QUERY", "sort query parameters of shortened URLs by name", func(c *Config) *bool { return &c.URLSortQuery }),
+	boolField("URL_BLOCK_PRIVATE", "reject URLs pointing at loopback, private or link-local addresses", func(c *Config) *bool { return &c.URLBlockPrivate }),
+	boolField("URL_RESOLVE_HOSTS", "resolve host names of shortened URLs for URL_BLOCK_PRIVATE", func(c *Config) *bool { return &c.URLResolveHosts }),
+	stringField("URL_SHORTENERS", "comma-separated domains of other URL shorteners that cannot be shortened", func(c *Config) *string { return &c.URLShorteners }),
+	stringField("POLICY_FILE", "destination rules file, empty disables rules", func(c *Config) *string { return &c.PolicyFile }),
+	durationField("POLICY_RELOAD_INTERVAL", "how often the destination rules file is checked for changes", func(c *Config) *time.Duration { return &c.PolicyReloadInterval }),
+	stringField("POLICY_HASH_FILE", "file of unsafe URL expressions or their SHA-256 hashes, empty disables it", func(c *Config) *string { return &c.PolicyHashFile }),
+	boolField("POLICY_INTERSTITIAL", "show a warning page before redirecting to flagged destinations", func(c *Config) *bool { return &c.PolicyInterstitial }),
+	stringField("REPO", "storage backend: in-memory, file, bolt, redis or postgres", func(c *Config) *string { return &c.Repo }),
+	stringField("PG_URL", "PostgreSQL connection string", func(c *Config) *string { return &c.PGURL }),
+	durationField("REAP_INTERVAL", "how often expired links are purged", func(c *Config) *time.Duration { return &c.ReapInterval }),
+	durationField("STORAGE_REDIRECT_TIMEOUT", "timeout of the storage lookup behind a redirect, 0 disables", func(c *Config) *time.Duration { return &c.StorageRedirectTimeout }),
+	durationField("STORAGE_READ_TIMEOUT", "timeout of storage reads, 0 disables", func(c *Config) *time.Duration { return &c.StorageReadTimeout }),
+	durationField("STORAGE_WRITE_TIMEOUT", "timeout of storage writes, 0 disables", func(c *Config) *time.Duration { return &c.StorageWriteTimeout }),
+	durationField("STORAGE_STATS_TIMEOUT", "timeout of link stats queries, 0 disables", func(c *Config) *time.Duration { return &c.StorageStatsTimeout }),
+	durationField("STORAGE_PING_TIMEOUT", "timeout of storage health checks, 0 disables", func(c *Config) *time.Duration { return &c.StoragePingTimeout }),
+	stringField("FILE_STORAGE_PATH", "log file of the file backend", func(c *Config) *string { return &c.FileStoragePath }),
+	stringField("FILE_SYNC", "fsync policy of the file backend: always, interval or never", func(c *Config) *string { return &c.FileSync }),
+	durationField("FILE_SYNC_INTERVAL", "how often the file backend fsyncs with FILE_SYNC=interval", func(c *Config) *time.Duration { return &c.FileSyncInterval }),
+	durationField("FILE_COMPACT_INTERVAL", "how often the file backend compacts its log, 0 disables", func(c *Config) *time.Duration { return &c.FileCompactInterval }),
+	stringField("BOLT_PATH", "database file of the bolt backend", func(c *Config) *string { return &c.BoltPath }),
+	stringField("BOLT_BACKUP_DIR", "directory for bolt snapshots, empty disables backups", func(c *Config) *string { return &c.BoltBackupDir }),
+	durationField("BOLT_BACKUP_INTERVAL", "how often the bolt backend is snapshotted", func(c *Config) *time.Duration { return &c.BoltBackupInterval }),
+	stringField("REDIS_URL", "Redis connection URL, e.g. redis://localhost:6379/0", func(c *Config) *string { return &c.RedisURL }),
+	boolField("REDIS_CACHE", "cache redirects in Redis in front of the storage backend", func(c *Config) *bool { return &c.RedisCache }),
+	durationField("REDIS_CACHE_TTL", "how long redirects stay in the Redis cache", func(c *Config) *time.Duration { return &c.RedisCacheTTL }),
+	intField("CACHE_SIZE", "number of redirects kept in the in-process cache, 0 disables it", func(c *Config) *int { return &c.CacheSize }),
+	durationField("CACHE_TTL", "how long resolved redirects stay in the in-process cache", func(c *Config) *time.Duration { return &c.CacheTTL }),
+	durationField("CACHE_NEGATIVE_TTL", "how long unknown, deleted and expired codes stay in the in-process cache", func(c *Config) *time.Duration { return &c.CacheNegativeTTL }),
+	intField("RATE_LIMIT_SHORTEN", "shorten requests allowed per RATE_LIMIT_WINDOW, 0 disables the limit", func(c *Config) *int { return &c.RateLimitShorten }),
+	intField("RATE_LIMIT_BATCH", "batch requests allowed per RATE_LIMIT_WINDOW, 0 disables the limit", func(c *Config) *int { return &c.RateLimitBatch }),
+	intField("RATE_LIMIT_REDIRECT", "redirects allowed per RATE_LIMIT_WINDOW, 0 disables the limit", func(c *Config) *int { return &c.RateLimitRedirect }),
+	durationField("RATE_LIMIT_WINDOW", "period in which a rate limit budget refills", func(c *Config) *time.Duration { return &c.RateLimitWindow }),
+	stringField("RATE_LIMIT_KEY", "what rate limits are counted by: user, ip or user,ip", func(c *Config) *string { return &c.RateLimitKey }),
+	boolField("RATE_LIMIT_TRUST_PROXY", "take the client address from the last X-Forwarded-For entry", func(c *Config) *bool { return &c.RateLimitTrustProxy }),
+	stringField("RATE_LIMIT_BACKEND", "where rate limit buckets are kept: memory or redis", func(c *Config) *string { return &c.RateLimitBackend }),
+	stringField("KEY", "secret used to sign user cookies", func(c *Config) *string { return &c.AuthKey }),
+	stringField("API_KEYS_FILE", "file for API keys unless REPO is postgres, empty keeps them in memory", func(c *Config) *string { return &c.APIKeysFile }),
+	intField("CLICK_BUFFER_SIZE", "number of clicks buffered before new ones are dropped", func(c *Config) *int { return &c.ClickBufferSize }),
+	intField("CLICK_BATCH_SIZE", "number of clicks written to storage at once", func(c *Config) *int { return &c.ClickBatchSize }),
+	durationField("CLICK_FLUSH_INTERVAL", "how often buffered clicks are written", func(c *Config) *time.Duration { return &c.ClickFlushInterval }),
+	intField("DELETE_WORKERS", "number of deletion workers", func(c *Config) *int { return &c.DeleteWorkers }),
+	intField("DELETE_QUEUE_SIZE", "number of pending deletion requests", func(c *Config) *int { return &c.DeleteQueueSize }),
+	intField("DELETE_BATCH_SIZE", "number of URLs that triggers a deletion flush", func(c *Config) *int { return &c.DeleteBatchSize }),
+	durationField("DELETE_FLUSH_INTERVAL", "how often pending deletions are flushed", func(c *Config) *time.Duration { return &c.DeleteFlushInterval }),
+}
+
+// Load resolves the configuration from args (without the program name),
+// the environment and the optional config file, and validates it.
+func Load(args []string, getenv func(string) string) (*Config, error) {
+	cfg := Default()
+
+	fs := flag.NewFlagSet("urlshortener", flag.ContinueOnError)
+	configPath := fs.String("config", getenv("CONFIG"), "path to a YAML config file")
+	flagValues := make(map[string]*string, len(fields))
+	for _, f := range fields {
+		flagValues[f.name] = fs.String(f.flagName(), "", f.usage+" (env "+f.name+")")
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *configPath != "" {
+		if err := cfg.loadFile(*configPath); err != nil {
+			return nil, err
+		}
+	}
+	for _, f := range fields {
+		if v := getenv(f.name); v != "" {
+			if err := f.set(&cfg, v); err != nil {
+				return nil, err
+			}
+		}
+	}
+	var flagErr error
+	fs.Visit(func(fl *flag.Flag) {
+		for _, f := range fields {
+			if f.flagName() == fl.Name && flagErr == nil {
+				flagErr = f.set(&cfg, *flagValues[f.name])
+			}
+		}
+	})
+	if flagErr != nil {
+		return nil, flagErr
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	var values map[string]any
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	known := make(map[string]field, len(fields))
+	for _, f := range fields {
+		known[f.fileKey()] = f
+	}
+	for key, value := range values {
+		f, ok := known[key]
+		if !ok {
+			return fmt.Errorf("config file %s: unknown key %q", path, key)
+		}
+		if err := f.set(c, fmt.Sprint(value)); err != nil {
+			return fmt.Errorf("config file %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// base62 is the alphabet of the counter and hash generators, which do not
+// use CHARSET.
+const base62 = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+func uniqueRunes(s string) int {
+	seen := make(map[rune]bool)
+	for _, r := range s {
+		seen[r] = true
+	}
+	return len(seen)
+}
+
+// urlSafe lists the characters a short code may use without being escaped
+// in a path: the unreserved set of RFC 3986.
+const urlSafe = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-._~"
+
+// checkCharset rejects a CHARSET whose characters would need escaping in a
+// short URL or appear more than once.
+func checkCharset(charset string) error {
+	var unsafe, dup []rune
+	seen := make(map[rune]bool)
+	for _, r := range charset {
+		switch {
+		case !strings.ContainsRune(urlSafe, r):
+			unsafe = append(unsafe, r)
+		case seen[r]:
+			dup = append(dup, r)
+		}
+		seen[r] = true
+	}
+	switch {
+	case len(unsafe) > 0:
+		return fmt.Errorf("CHARSET may only use letters, digits and -._~, got %q", string(unsafe))
+	case len(dup) > 0:
+		return fmt.Errorf("CHARSET must not repeat characters, got %q more than once", string(dup))
+	}
+	return nil
+}
+
+func (c *Config) Validate() error {
+	var errs []error
+	if c.ServerAddress == "" {
+		errs = append(errs, errors.New("SERVER_ADDRESS must not be empty"))
+	}
+	if u, err := url.Parse(c.Domain); err != nil || u.Scheme == "" || u.Host == "" {
+		errs = append(errs, fmt.Errorf("DOMAIN must be an absolute URL like https://sho.rt/, got %q", c.Domain))
+	}
+	if c.Charset == "" {
+		errs = append(errs, errors.New("CHARSET must not be empty"))
+	} else if err := checkCharset(c.Charset); err != nil {
+		errs = append(errs, err)
+	}
+	if c.Length <= 0 {
+		errs = append(errs, fmt.Errorf("LENGTH must be positive, got %d", c.Length))
+	}
+	switch c.Generator {
+	case "random":
+	case "counter", "hash":
+		if missing := strings.Map(func(r rune) rune {
+			if strings.ContainsRune(c.Charset, r) {
+				return -1
+			}
+			return r
+		}, base62); missing != "" {
+			errs = append(errs, fmt.Errorf("GENERATOR %s emits base62 codes, CHARSET lacks %q", c.Generator, missing))
+		}
+	case "hashids":
+		if c.Charset != "" && (uniqueRunes(c.Charset) < 16 || strings.ContainsRune(c.Charset, ' ')) {
+			errs = append(errs, errors.New("GENERATOR hashids needs a CHARSET of at least 16 unique characters without spaces"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("GENERATOR must be random, counter, hashids or hash, got %q", c.Generator))
+	}
+	if strings.Trim(c.URLSchemes, ", ") == "" {
+		errs = append(errs, errors.New("URL_SCHEMES must not be empty"))
+	}
+	if c.URLMaxLength <= 0 {
+		errs = append(errs, fmt.Errorf("URL_MAX_LENGTH must be positive, got %d", c.URLMaxLength))
+	}
+	switch c.URLTrailingSlash {
+	case "keep", "strip":
+	default:
+		errs = append(errs, fmt.Errorf("URL_TRAILING_SLASH must be keep or strip, got %q", c.URLTrailingSlash))
+	}
+	if c.PolicyFile != "" && c.PolicyReloadInterval <= 0 {
+		errs = append(errs, fmt.Errorf("POLICY_RELOAD_INTERVAL must be positive, got %s", c.PolicyReloadInterval))
+	}
+	switch c.Repo {
+	case "in-memory":
+	case "file":
+		if c.FileStoragePath == "" {
+			errs = append(errs, errors.New("FILE_STORAGE_PATH is required when REPO is file"))
+		}
+		switch c.FileSync {
+		case "always", "never":
+		case "interval":
+			if c.FileSyncInterval <= 0 {
+				errs = append(errs, fmt.Errorf("FILE_SYNC_INTERVAL must be positive, got %s", c.FileSyncInterval))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("FILE_SYNC must be always, interval or never, got %q", c.FileSync))
+		}
+		if c.FileCompactInterval < 0 {
+			errs = append(errs, fmt.Errorf("FILE_COMPACT_INTERVAL must not be negative, got %s", c.FileCompactInterval))
+		}
+	case "bolt":
+		if c.BoltPath == "" {
+			errs = append(errs, errors.New("BOLT_PATH is required when REPO is bolt"))
+		}
+		if c.BoltBackupDir != "" && c.BoltBackupInterval <= 0 {
+			errs = append(errs, fmt.Errorf("BOLT_BACKUP_INTERVAL must be positive, got %s", c.BoltBackupInterval))
+		}
+	case "redis":
+		if c.RedisURL == "" {
+			errs = append(errs, errors.New("REDIS_URL is required when REPO is redis"))
+		}
+		if c.RedisCache {
+			errs = append(errs, errors.New("REDIS_CACHE makes no sense when REPO is redis"))
+		}
+	case "postgres":
+		if c.PGURL == "" {
+			errs = append(errs, errors.New("PG_URL is required when REPO is postgres"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("REPO must be in-memory, file, bolt, redis or postgres, got %q", c.Repo))
+	}
+	if c.RedisCache {
+		if c.RedisURL == "" {
+			errs = append(errs, errors.New("REDIS_URL is required when REDIS_CACHE is set"))
+		}
+		if c.RedisCacheTTL <= 0 {
+			errs = append(errs, fmt.Errorf("REDIS_CACHE_TTL must be positive, got %s", c.RedisCacheTTL))
+		}
+	}
+	timeouts := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"STORAGE_REDIRECT_TIMEOUT", c.StorageRedirectTimeout},
+		{"STORAGE_READ_TIMEOUT", c.StorageReadTimeout},
+		{"STORAGE_WRITE_TIMEOUT", c.StorageWriteTimeout},
+		{"STORAGE_STATS_TIMEOUT", c.StorageStatsTimeout},
+		{"STORAGE_PING_TIMEOUT", c.StoragePingTimeout},
+	}
+	for _, d := range timeouts {
+		if d.value < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative, got %s", d.name, d.value))
+		}
+	}
+	if c.CacheSize < 0 {
+		errs = append(errs, fmt.Errorf("CACHE_SIZE must not be negative, got %d", c.CacheSize))
+	}
+	if c.CacheSize > 0 {
+		if c.CacheTTL <= 0 {
+			errs = append(errs, fmt.Errorf("CACHE_TTL must be positive, got %s", c.CacheTTL))
+		}
+		if c.CacheNegativeTTL < 0 {
+			errs = append(errs, fmt.Errorf("CACHE_NEGATIVE_TTL must not be negative, got %s", c.CacheNegativeTTL))
+		}
+	}
+	for _, l := range []struct {
+		name  string
+		value int
+	}{
+		{"RATE_LIMIT_SHORTEN", c.RateLimitShorten},
+		{"RATE_LIMIT_BATCH", c.RateLimitBatch},
+		{"RATE_LIMIT_REDIRECT", c.RateLimitRedirect},
+	} {
+		if l.value < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative, got %d", l.name, l.value))
+		}
+	}
+	if c.RateLimitShorten > 0 || c.RateLimitBatch > 0 || c.RateLimitRedirect > 0 {
+		if c.RateLimitWindow <= 0 {
+			errs = append(errs, fmt.Errorf("RATE_LIMIT_WINDOW must be positive, got %s", c.RateLimitWindow))
+		}
+		switch c.RateLimitKey {
+		case "user", "ip", "user,ip":
+		default:
+			errs = append(errs, fmt.Errorf("RATE_LIMIT_KEY must be user, ip or user,ip, got %q", c.RateLimitKey))
+		}
+		switch c.RateLimitBackend {
+		case "memory":
+		case "redis":
+			if c.RedisURL == "" {
+				errs = append(errs, errors.New("REDIS_URL is required when RATE_LIMIT_BACKEND is redis"))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("RATE_LIMIT_BACKEND must be memory or redis, got %q", c.RateLimitBackend))
+		}
+	}
+	if c.AuthKey == "" {
+		errs = append(errs, errors.New("KEY must be set to sign user cookies"))
+	}
+	durations := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"SHUTDOWN_TIMEOUT", c.ShutdownTimeout},
+		{"REAP_INTERVAL", c.ReapInterval},
+		{"CLICK_FLUSH_INTERVAL", c.ClickFlushInterval},
+		{"DELETE_FLUSH_INTERVAL", c.DeleteFlushInterval},
+	}
+	for _, d := range durations {
+		if d.value <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be positive, got %s", d.name, d.value))
+		}
+	}
+	sizes := []struct {
+		name  string
+		value int
+	}{
+		{"CLICK_BUFFER_SIZE", c.ClickBufferSize},
+		{"CLICK_BATCH_SIZE", c.ClickBatchSize},
+		{"DELETE_WORKERS", c.DeleteWorkers},
+		{"DELETE_QUEUE_SIZE", c.DeleteQueueSize},
+		{"DELETE_BATCH_SIZE", c.DeleteBatchSize},
+	}
+	for _, n := range sizes {
+		if n.value <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be positive, got %d", n.name, n.value))
+		}
+	}
+	return errors.Join(errs...)
+}
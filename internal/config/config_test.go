@@ -0,0 +1,99 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func envFrom(values map[string]string) func(string) string {
+	return func(key string) string { return values[key] }
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(path, []byte("domain: https://file.example/\nlength: 7\nreap_interval: 2m\nkey: file-key\n"), 0o600)
+	require.NoError(t, err)
+
+	cfg, err := Load([]string{"-config", path, "-length", "12"}, envFrom(map[string]string{
+		"DOMAIN": "https://env.example/",
+		"LENGTH": "9",
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, "https://env.example/", cfg.Domain, "env overrides the file")
+	assert.Equal(t, 12, cfg.Length, "flags override env")
+	assert.Equal(t, 2*time.Minute, cfg.ReapInterval, "file overrides defaults")
+	assert.Equal(t, "file-key", cfg.AuthKey)
+	assert.Equal(t, ":8080", cfg.ServerAddress, "defaults apply when nothing is set")
+}
+
+func TestLoadValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		err  string
+	}{
+		{
+			name: "Non-numeric LENGTH",
+			env:  map[string]string{"KEY": "k", "LENGTH": "ten"},
+			err:  `LENGTH must be a whole number, got "ten"`,
+		},
+		{
+			name: "Empty CHARSET",
+			args: []string{"-charset", ""},
+			env:  map[string]string{"KEY": "k"},
+			err:  "CHARSET must not be empty",
+		},
+		{
+			name: "CHARSET with URL delimiters",
+			env:  map[string]string{"KEY": "k", "CHARSET": "abc/def?ghi%jkl"},
+			err:  `CHARSET may only use letters, digits and -._~, got "/?%"`,
+		},
+		{
+			name: "CHARSET with multibyte runes",
+			env:  map[string]string{"KEY": "k", "CHARSET": "abcdefжз"},
+			err:  `CHARSET may only use letters, digits and -._~, got "жз"`,
+		},
+		{
+			name: "CHARSET with duplicates",
+			env:  map[string]string{"KEY": "k", "CHARSET": "abcabc123"},
+			err:  `CHARSET must not repeat characters, got "abc" more than once`,
+		},
+		{
+			name: "Counter with a CHARSET lacking base62",
+			env:  map[string]string{"KEY": "k", "GENERATOR": "counter", "CHARSET": "abcdefghijklmnopqrstuvwxyz0123456789"},
+			err:  `GENERATOR counter emits base62 codes, CHARSET lacks "ABCDEFGHIJKLMNOPQRSTUVWXYZ"`,
+		},
+		{
+			name: "Hashids with a short CHARSET",
+			env:  map[string]string{"KEY": "k", "GENERATOR": "hashids", "CHARSET": "abcdef"},
+			err:  "GENERATOR hashids needs a CHARSET of at least 16 unique characters without spaces",
+		},
+		{
+			name: "Missing KEY",
+			err:  "KEY must be set to sign user cookies",
+		},
+		{
+			name: "Postgres without PG_URL",
+			env:  map[string]string{"KEY": "k", "REPO": "postgres"},
+			err:  "PG_URL is required when REPO is postgres",
+		},
+		{
+			name: "Unknown REPO",
+			env:  map[string]string{"KEY": "k", "REPO": "mongo"},
+			err:  `REPO must be in-memory, file, bolt, redis or postgres, got "mongo"`,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Load(tc.args, envFrom(tc.env))
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tc.err)
+		})
+	}
+}
@@ -0,0 +1,263 @@
+package deleter
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Polad20/urlshortener/internal/storage"
+)
+
+var (
+	ErrPoolClosed = errors.New("deletion pool is closed")
+	ErrQueueFull  = errors.New("deletion queue is full")
+)
+
+// jobRetention is how long finished jobs stay visible through Status.
+const jobRetention = time.Hour
+
+type JobStatus string
+
+const (
+	StatusPending JobStatus = "pending"
+	StatusDone    JobStatus = "done"
+	StatusFailed  JobStatus = "failed"
+)
+
+type Job struct {
+	ID         string     `json:"job_id"`
+	UserID     string     `json:"-"`
+	Status     JobStatus  `json:"status"`
+	Error      string     `json:"error,omitempty"`
+	URLs       int        `json:"urls"`
+	CreatedAt  time.Time  `json:"created_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// Deleter is the part of storage.Storage the pool needs.
+type Deleter interface {
+	DeleteURLs(ctx context.Context, userID string, shortURLs []string) error
+}
+
+type request struct {
+	jobID     string
+	userID    string
+	shortURLs []string
+}
+
+// batch is one DeleteURLs call covering the requests of several jobs of the
+// same user.
+type batch struct {
+	userID    string
+	shortURLs []string
+	jobIDs    []string
+}
+
+// Pool is a bounded set of workers shared by all users. Submitted requests
+// are coalesced per user and flushed to storage once batchSize URLs are
+// pending or flushInterval passes, whichever comes first.
+type Pool struct {
+	repo          Deleter
+	requests      chan request
+	work          chan batch
+	workers       int
+	batchSize     int
+	flushInterval time.Duration
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	lock   sync.RWMutex
+	closed bool
+	jobs   map[string]*Job
+}
+
+func NewPool(repo Deleter, workers, queueSize, batchSize int, flushInterval time.Duration) *Pool {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Pool{
+		repo:          repo,
+		requests:      make(chan request, queueSize),
+		work:          make(chan batch, workers),
+		workers:       workers,
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		ctx:           ctx,
+		cancel:        cancel,
+		jobs:          make(map[string]*Job),
+	}
+}
+
+func (p *Pool) Start() {
+	p.wg.Add(1)
+	go p.coalesce()
+	for i := 0; i < p.workers; i++ {
+		p.wg.Add(1)
+		go p.worker()
+	}
+}
+
+// Submit queues shortURLs of userID for deletion and returns the job ID.
+func (p *Pool) Submit(userID string, shortURLs []string) (string, error) {
+	id, err := newJobID()
+	if err != nil {
+		return "", err
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		return "", ErrPoolClosed
+	}
+	select {
+	case p.requests <- request{jobID: id, userID: userID, shortURLs: shortURLs}:
+	default:
+		return "", ErrQueueFull
+	}
+	p.jobs[id] = &Job{
+		ID:        id,
+		UserID:    userID,
+		Status:    StatusPending,
+		URLs:      len(shortURLs),
+		CreatedAt: time.Now(),
+	}
+	return id, nil
+}
+
+// Status returns a copy of the job if it exists and belongs to userID.
+func (p *Pool) Status(userID, jobID string) (Job, bool) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	job, ok := p.jobs[jobID]
+	if !ok || job.UserID != userID {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// Close stops accepting new jobs and waits until the queued ones are
+// written. If ctx expires first, in-flight deletes are cancelled.
+func (p *Pool) Close(ctx context.Context) error {
+	p.lock.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.requests)
+	}
+	p.lock.Unlock()
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		p.cancel()
+		return nil
+	case <-ctx.Done():
+		p.cancel()
+		return ctx.Err()
+	}
+}
+
+func (p *Pool) coalesce() {
+	defer p.wg.Done()
+	defer close(p.work)
+	ticker := time.NewTicker(p.flushInterval)
+	defer ticker.Stop()
+	pending := make(map[string]*batch)
+	size := 0
+	flush := func() {
+		for userID, b := range pending {
+			p.work <- *b
+			delete(pending, userID)
+		}
+		size = 0
+	}
+	for {
+		select {
+		case req, ok := <-p.requests:
+			if !ok {
+				flush()
+				return
+			}
+			b, ok := pending[req.userID]
+			if !ok {
+				b = &batch{userID: req.userID}
+				pending[req.userID] = b
+			}
+			b.shortURLs = append(b.shortURLs, req.shortURLs...)
+			b.jobIDs = append(b.jobIDs, req.jobID)
+			size += len(req.shortURLs)
+			if size >= p.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+			p.pruneJobs(time.Now())
+		}
+	}
+}
+
+func (p *Pool) worker() {
+	defer p.wg.Done()
+	for b := range p.work {
+		err := p.repo.DeleteURLs(p.ctx, b.userID, b.shortURLs)
+		if err != nil {
+			log.Printf("Batch Error - failed to delete %d URLs for user %s: %v", len(b.shortURLs), b.userID, err)
+		}
+		p.finish(b.jobIDs, err)
+	}
+}
+
+func (p *Pool) finish(jobIDs []string, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := time.Now()
+	for _, id := range jobIDs {
+		job, ok := p.jobs[id]
+		if !ok {
+			continue
+		}
+		job.Status = StatusDone
+		if err != nil {
+			job.Status = StatusFailed
+			job.Error = jobError(err)
+		}
+		job.FinishedAt = &now
+	}
+}
+
+// jobError is the failure reported to the job owner. The storage error
+// itself may carry driver or SQL details, so only its class is shown; the
+// worker logs the rest.
+func jobError(err error) string {
+	switch {
+	case errors.Is(err, storage.ErrUnavailable), errors.Is(err, context.DeadlineExceeded):
+		return storage.ErrUnavailable.Error()
+	case errors.Is(err, context.Canceled):
+		return "deletion interrupted by shutdown"
+	default:
+		return "deletion failed"
+	}
+}
+
+func (p *Pool) pruneJobs(now time.Time) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for id, job := range p.jobs {
+		if job.FinishedAt != nil && now.Sub(*job.FinishedAt) > jobRetention {
+			delete(p.jobs, id)
+		}
+	}
+}
+
+func newJobID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
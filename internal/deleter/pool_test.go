@@ -0,0 +1,89 @@
+package deleter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Polad20/urlshortener/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeDeleter struct {
+	lock  sync.Mutex
+	calls map[string][][]string
+}
+
+func (f *fakeDeleter) DeleteURLs(ctx context.Context, userID string, shortURLs []string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.calls[userID] = append(f.calls[userID], shortURLs)
+	return nil
+}
+
+func TestPoolCoalescesAndDrains(t *testing.T) {
+	repo := &fakeDeleter{calls: make(map[string][][]string)}
+	p := NewPool(repo, 2, 10, 100, time.Hour)
+	p.Start()
+
+	first, err := p.Submit("user1", []string{"a", "b"})
+	require.NoError(t, err)
+	second, err := p.Submit("user1", []string{"c"})
+	require.NoError(t, err)
+	_, err = p.Submit("user2", []string{"d"})
+	require.NoError(t, err)
+
+	job, ok := p.Status("user1", first)
+	require.True(t, ok)
+	assert.Equal(t, StatusPending, job.Status)
+	_, ok = p.Status("user2", first)
+	assert.False(t, ok, "jobs are only visible to their owner")
+
+	require.NoError(t, p.Close(context.Background()))
+	assert.Equal(t, [][]string{{"a", "b", "c"}}, repo.calls["user1"], "requests of one user are coalesced into one batch")
+	assert.Equal(t, [][]string{{"d"}}, repo.calls["user2"])
+	for _, id := range []string{first, second} {
+		job, ok := p.Status("user1", id)
+		require.True(t, ok)
+		assert.Equal(t, StatusDone, job.Status)
+	}
+
+	_, err = p.Submit("user1", []string{"e"})
+	assert.ErrorIs(t, err, ErrPoolClosed)
+}
+
+type failingDeleter struct {
+	err error
+}
+
+func (f failingDeleter) DeleteURLs(ctx context.Context, userID string, shortURLs []string) error {
+	return f.err
+}
+
+func TestFailedJobHidesStorageErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "Internal", err: errors.New(`pq: relation "urls" does not exist`), want: "deletion failed"},
+		{name: "Unavailable", err: fmt.Errorf("dial tcp 10.0.0.5:5432: %w", storage.ErrUnavailable), want: storage.ErrUnavailable.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewPool(failingDeleter{err: tt.err}, 1, 10, 100, time.Hour)
+			p.Start()
+			id, err := p.Submit("user1", []string{"a"})
+			require.NoError(t, err)
+			require.NoError(t, p.Close(context.Background()))
+			job, ok := p.Status("user1", id)
+			require.True(t, ok)
+			assert.Equal(t, StatusFailed, job.Status)
+			assert.Equal(t, tt.want, job.Error)
+		})
+	}
+}
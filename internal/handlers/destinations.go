@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"context"
+	"html/template"
+	"log"
+	"net/http"
+
+	"github.com/Polad20/urlshortener/internal/policy"
+)
+
+// Destinations applies the destination policy when links are shortened and
+// when they are followed, so links blocked later stop redirecting too.
+type Destinations struct {
+	// Checker may be nil, which allows every destination.
+	Checker policy.Checker
+	// Interstitial shows a warning page instead of redirecting straight
+	// away for destinations the policy flags with policy.Warn.
+	Interstitial bool
+}
+
+func (d Destinations) check(ctx context.Context, url string) policy.Decision {
+	if d.Checker == nil {
+		return policy.Decision{}
+	}
+	decision, err := d.Checker.Check(ctx, url)
+	if err != nil {
+		log.Printf("Destination policy check failed for %s: %v", url, err)
+		return policy.Decision{}
+	}
+	return decision
+}
+
+// refuse answers blocked destinations and reports whether it did.
+func refuse(w http.ResponseWriter, r *http.Request, decision policy.Decision, detail string) bool {
+	switch decision.Action {
+	case policy.Block:
+		writeProblem(w, r, http.StatusForbidden, detail+"destination is blocked")
+	case policy.Legal:
+		writeProblem(w, r, http.StatusUnavailableForLegalReasons, detail+"destination is unavailable for legal reasons")
+	default:
+		return false
+	}
+	return true
+}
+
+var interstitialPage = template.Must(template.New("interstitial").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><meta name="robots" content="noindex"><title>Warning</title></head>
+<body>
+<h1>This link may be unsafe</h1>
+<p>The short link you followed leads to <code>{{.Destination}}</code>, which has been flagged as potentially harmful.</p>
+<p><a href="{{.Continue}}" rel="noreferrer nofollow">Continue anyway</a></p>
+</body>
+</html>
+`))
+
+func writeInterstitial(w http.ResponseWriter, r *http.Request, destination string) {
+	next := *r.URL
+	query := next.Query()
+	query.Set("confirm", "1")
+	next.RawQuery = query.Encode()
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	err := interstitialPage.Execute(w, struct {
+		Destination string
+		Continue    string
+	}{destination, next.RequestURI()})
+	if err != nil {
+		log.Printf("Error rendering interstitial page: %v", err)
+	}
+}
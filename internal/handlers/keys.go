@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Polad20/urlshortener/internal/auth"
+	"github.com/go-chi/chi/v5"
+)
+
+// apiKey is an API key as its owner sees it. Token is only set in the
+// answer to the request that created the key.
+type apiKey struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name,omitempty"`
+	Scopes     []string   `json:"scopes"`
+	Token      string     `json:"key,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+func newAPIKey(key auth.APIKey) apiKey {
+	return apiKey{
+		ID:         key.ID,
+		Name:       key.Name,
+		Scopes:     key.Scopes,
+		CreatedAt:  key.CreatedAt,
+		LastUsedAt: key.LastUsedAt,
+		RevokedAt:  key.RevokedAt,
+	}
+}
+
+func (h *Handler) createKey() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := r.Context().Value("userID").(string)
+		if !ok {
+			writeProblem(w, r, http.StatusInternalServerError, "Can`t convert userID to string")
+			return
+		}
+		var req struct {
+			Name   string   `json:"name"`
+			Scopes []string `json:"scopes"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "Invalid JSON format")
+			return
+		}
+		if len(req.Scopes) == 0 {
+			req.Scopes = auth.DefaultScopes
+		}
+		// A key can only hand out scopes it holds itself.
+		for _, scope := range req.Scopes {
+			if !auth.HasScope(r.Context(), scope) {
+				writeProblem(w, r, http.StatusForbidden, fmt.Sprintf("cannot grant scope %q", scope))
+				return
+			}
+		}
+		key, token, err := h.auth.CreateKey(r.Context(), userID, req.Name, req.Scopes)
+		if errors.Is(err, auth.ErrUnknownScope) {
+			writeProblem(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		resp := newAPIKey(key)
+		resp.Token = token
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+func (h *Handler) listKeys() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := r.Context().Value("userID").(string)
+		if !ok {
+			writeProblem(w, r, http.StatusInternalServerError, "Can`t convert userID to string")
+			return
+		}
+		keys, err := h.auth.ListKeys(r.Context(), userID)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		resp := make([]apiKey, len(keys))
+		for i, key := range keys {
+			resp[i] = newAPIKey(key)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+func (h *Handler) revokeKey() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := r.Context().Value("userID").(string)
+		if !ok {
+			writeProblem(w, r, http.StatusInternalServerError, "Can`t convert userID to string")
+			return
+		}
+		if err := h.auth.RevokeKey(r.Context(), userID, chi.URLParam(r, "id")); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
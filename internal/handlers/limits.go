@@ -0,0 +1,18 @@
+package handlers
+
+import "net/http"
+
+// Limits are the rate limiting middlewares of the route groups. A nil
+// middleware leaves its group unlimited.
+type Limits struct {
+	Shorten  func(http.Handler) http.Handler
+	Batch    func(http.Handler) http.Handler
+	Redirect func(http.Handler) http.Handler
+}
+
+func limit(mw func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	if mw == nil {
+		return func(next http.Handler) http.Handler { return next }
+	}
+	return mw
+}
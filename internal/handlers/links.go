@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Links renders stored short codes as public URLs.
+type Links struct {
+	// BaseURL is prepended to codes, e.g. https://sho.rt/.
+	BaseURL string
+	// TrustForwardedHost makes X-Forwarded-Host (and X-Forwarded-Proto)
+	// override the host of BaseURL. Enable it only behind a proxy that sets
+	// these headers itself.
+	TrustForwardedHost bool
+}
+
+func (l Links) ShortURL(r *http.Request, code string) string {
+	base := l.BaseURL
+	if l.TrustForwardedHost {
+		if host := r.Header.Get("X-Forwarded-Host"); host != "" {
+			if u, err := url.Parse(base); err == nil {
+				u.Host = strings.TrimSpace(strings.Split(host, ",")[0])
+				if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+					u.Scheme = proto
+				}
+				base = u.String()
+			}
+		}
+	}
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	return base + code
+}
+
+// codeFromInput accepts either a bare code or a full short URL, as earlier
+// API versions returned and expected full URLs.
+func codeFromInput(s string) string {
+	if i := strings.LastIndex(s, "/"); i >= 0 {
+		return s[i+1:]
+	}
+	return s
+}
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/Polad20/urlshortener/internal/storage"
+)
+
+// problem is an RFC 7807 problem details body.
+type problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+}
+
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   detail,
+		Instance: r.URL.Path,
+	})
+}
+
+// writeError answers with the status matching the storage error class of
+// err. Anything unclassified is logged and reported as 500 without details.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		writeProblem(w, r, http.StatusNotFound, storage.ErrNotFound.Error())
+	case errors.Is(err, storage.ErrDeleted):
+		writeProblem(w, r, http.StatusGone, storage.ErrDeleted.Error())
+	case errors.Is(err, storage.ErrExpired):
+		writeProblem(w, r, http.StatusGone, storage.ErrExpired.Error())
+	case errors.Is(err, storage.ErrGone):
+		writeProblem(w, r, http.StatusGone, storage.ErrGone.Error())
+	case errors.Is(err, storage.ErrConflict):
+		writeProblem(w, r, http.StatusConflict, err.Error())
+	case errors.Is(err, storage.ErrUnavailable), errors.Is(err, context.DeadlineExceeded):
+		log.Printf("Storage unavailable for %s %s: %v", r.Method, r.URL.Path, err)
+		w.Header().Set("Retry-After", "1")
+		writeProblem(w, r, http.StatusServiceUnavailable, storage.ErrUnavailable.Error())
+	default:
+		log.Printf("Error handling %s %s: %v", r.Method, r.URL.Path, err)
+		writeProblem(w, r, http.StatusInternalServerError, "")
+	}
+}
@@ -3,16 +3,21 @@ package handlers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"time"
 
+	"github.com/Polad20/urlshortener/internal/analytics"
 	"github.com/Polad20/urlshortener/internal/auth"
+	"github.com/Polad20/urlshortener/internal/deleter"
 	"github.com/Polad20/urlshortener/internal/middleware"
 	"github.com/Polad20/urlshortener/internal/model"
+	"github.com/Polad20/urlshortener/internal/policy"
 	"github.com/Polad20/urlshortener/internal/shortener"
 	"github.com/Polad20/urlshortener/internal/storage"
-	"github.com/Polad20/urlshortener/internal/storage/pg"
+	"github.com/Polad20/urlshortener/internal/validation"
 	"github.com/go-chi/chi/v5"
 )
 
@@ -20,22 +25,44 @@ type Handler struct {
 	*chi.Mux
 	repo      storage.Storage
 	shortener *shortener.Shortener
+	validator *validation.Validator
+	recorder  *analytics.Recorder
+	deleter   *deleter.Pool
+	links     Links
+	dest      Destinations
+	auth      *auth.Auth
 }
 
-func NewHandler(repo storage.Storage, shortener *shortener.Shortener, authMiddleware *auth.Auth) *Handler {
+func NewHandler(repo storage.Storage, shortener *shortener.Shortener, validator *validation.Validator, authMiddleware *auth.Auth, recorder *analytics.Recorder, deleter *deleter.Pool, links Links, dest Destinations, limits Limits) *Handler {
 	h := &Handler{
 		Mux:       chi.NewMux(),
 		repo:      repo,
 		shortener: shortener,
+		validator: validator,
+		recorder:  recorder,
+		deleter:   deleter,
+		links:     links,
+		dest:      dest,
+		auth:      authMiddleware,
 	}
-	h.Use(authMiddleware.MiddlewareAuth)
 	h.Use(middleware.MiddlewareBrotliEncoder)
-	h.Get("/{id}", h.RedirectHandler())
-	h.Post("/api/pg/shorten/batch", h.SaveBaseURL())
-	h.Post("/api/user/urls", h.deleteBatch())
-	h.Post("/api/inmem/shorten", h.saveURL())
-	h.Get("/api/inmem/user/urls", h.getURL())
-	h.Get("/api/pg/ping", h.pingHandler())
+	h.With(limit(limits.Redirect)).Get("/{id}", h.RedirectHandler())
+	h.Group(func(r chi.Router) {
+		r.Use(authMiddleware.MiddlewareAuth)
+		r.With(limit(limits.Batch), auth.RequireScope(auth.ScopeShorten)).Post("/api/pg/shorten/batch", h.SaveBaseURL())
+		r.With(auth.RequireScope(auth.ScopeDelete)).Post("/api/user/urls", h.deleteBatch())
+		r.With(auth.RequireScope(auth.ScopeRead)).Get("/api/user/urls/delete/{job}", h.deleteStatus())
+		r.With(limit(limits.Shorten), auth.RequireScope(auth.ScopeShorten)).Post("/api/inmem/shorten", h.saveURL())
+		r.With(auth.RequireScope(auth.ScopeRead)).Get("/api/inmem/user/urls", h.getURL())
+		r.With(auth.RequireScope(auth.ScopeRead)).Get("/api/user/urls/{id}/stats", h.statsHandler())
+		r.Get("/api/pg/ping", h.pingHandler())
+		r.Route("/api/user/keys", func(r chi.Router) {
+			r.Use(auth.RequireScope(auth.ScopeKeys))
+			r.Post("/", h.createKey())
+			r.Get("/", h.listKeys())
+			r.Delete("/{id}", h.revokeKey())
+		})
+	})
 
 	return h
 }
@@ -55,25 +82,72 @@ func (h *Handler) saveURL() http.HandlerFunc {
 			return
 		}
 		var req struct {
-			OriginalURL string `json:"url"`
+			OriginalURL string     `json:"url"`
+			Alias       string     `json:"alias,omitempty"`
+			ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+			TTLSeconds  int64      `json:"ttl_seconds,omitempty"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeProblem(w, r, http.StatusBadRequest, err.Error())
 			return
 		}
 		defer r.Body.Close()
-		shortURL := h.shortener.Shorten()
-		err := h.repo.SaveURL(userID, shortURL, req.OriginalURL)
+		originalURL, err := h.validator.Validate(r.Context(), req.OriginalURL)
 		if err != nil {
-			http.Error(w, "Failed to Save URL", http.StatusInternalServerError)
-			log.Printf("Error saving URL to storage: %v", err)
+			writeProblem(w, r, http.StatusBadRequest, err.Error())
 			return
 		}
+		req.OriginalURL = originalURL
+		if refuse(w, r, h.dest.check(r.Context(), originalURL), "") {
+			return
+		}
+		expiresAt, err := expiry(req.ExpiresAt, req.TTLSeconds, time.Now())
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		var shortURL string
+		status := http.StatusOK
+		save := func() error {
+			return h.repo.SaveURL(r.Context(), userID, model.ShortenedURL{
+				ShortURL:    shortURL,
+				OriginalURL: req.OriginalURL,
+				ExpiresAt:   expiresAt,
+			})
+		}
+		if req.Alias != "" {
+			shortURL, err = h.shortener.Alias(req.Alias)
+			if err != nil {
+				writeProblem(w, r, http.StatusBadRequest, err.Error())
+				return
+			}
+			err = save()
+		} else {
+			err = h.shortener.Retry(func() error {
+				var err error
+				shortURL, err = h.shortener.Shorten(r.Context(), req.OriginalURL)
+				if err != nil {
+					return err
+				}
+				return save()
+			})
+		}
+		var conflict *storage.ConflictError
+		if errors.As(err, &conflict) {
+			shortURL = conflict.ShortURL
+			status = http.StatusConflict
+		} else if errors.Is(err, storage.ErrShortURLTaken) {
+			writeProblem(w, r, http.StatusConflict, shortener.ErrAliasTaken.Error())
+			return
+		} else if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
 		encoder := json.NewEncoder(w)
 		encoder.SetEscapeHTML(false)
-		encoder.Encode(map[string]string{"result": shortURL})
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
+		encoder.Encode(map[string]string{"result": h.links.ShortURL(r, shortURL)})
 	}
 }
 
@@ -81,7 +155,7 @@ func (h *Handler) getURL() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		userIDinter := r.Context().Value("userID")
 		if userIDinter == nil {
-			http.Error(w, "You don`t have userID to get URL`s", http.StatusBadRequest)
+			writeProblem(w, r, http.StatusBadRequest, "You don`t have userID to get URL`s")
 			return
 		}
 		userID, ok := userIDinter.(string)
@@ -90,11 +164,14 @@ func (h *Handler) getURL() http.HandlerFunc {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		urls, err := h.repo.GetURLsByUser(userID)
+		urls, err := h.repo.GetURLsByUser(r.Context(), userID)
 		if err != nil {
-			http.Error(w, "Error getting url`s", http.StatusInternalServerError)
+			writeError(w, r, err)
 			return
 		}
+		for i := range urls {
+			urls[i].ShortURL = h.links.ShortURL(r, urls[i].ShortURL)
+		}
 		encoder := json.NewEncoder(w)
 		encoder.SetEscapeHTML(false)
 		encoder.Encode(urls)
@@ -106,9 +183,9 @@ func (h *Handler) getURL() http.HandlerFunc {
 
 func (h *Handler) pingHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		err := h.repo.Ping(context.Background())
+		err := h.repo.Ping(r.Context())
 		if err != nil {
-			http.Error(w, "DB connection error", http.StatusInternalServerError)
+			writeError(w, r, err)
 			return
 		}
 		w.WriteHeader(http.StatusOK)
@@ -117,30 +194,64 @@ func (h *Handler) pingHandler() http.HandlerFunc {
 
 func (h *Handler) RedirectHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		userID := r.Context().Value("userID")
-		userIDValue, ok := userID.(string)
-		if !ok {
-			http.Error(w, "Error: userID is not a string", http.StatusBadRequest)
-			log.Printf("userID is not a string")
-			return
-		}
 		id := chi.URLParam(r, "id")
 		if id == "" {
 			log.Printf("Redirect Handler Error: ID not found in URL path")
-			http.Error(w, "Invalid request path", http.StatusBadRequest)
+			writeProblem(w, r, http.StatusBadRequest, "Invalid request path")
 			return
 		}
-		shortURL := fmt.Sprintf("http://localhost:8080/%s", id)
-		originalURL, err := h.repo.FindUsersOrigURL(userIDValue, shortURL)
+		shortURL := id
+		originalURL, err := h.repo.FindOrigURL(r.Context(), shortURL)
 		if err != nil {
-			log.Printf("Redirect Handler Error: Failed 	to get original URL for '%s': %v", shortURL, err)
-			http.Error(w, "Cant find original url for given short", http.StatusInternalServerError)
+			writeError(w, r, err)
+			return
+		}
+		decision := h.dest.check(r.Context(), originalURL)
+		if refuse(w, r, decision, "") {
+			return
+		}
+		if decision.Action == policy.Warn && h.dest.Interstitial && r.URL.Query().Get("confirm") != "1" {
+			writeInterstitial(w, r, originalURL)
 			return
 		}
+		h.recorder.Record(analytics.NewClick(shortURL, r, time.Now()))
 		http.Redirect(w, r, originalURL, http.StatusTemporaryRedirect)
 	}
 }
 
+func (h *Handler) statsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := r.Context().Value("userID").(string)
+		if !ok {
+			writeProblem(w, r, http.StatusInternalServerError, "Can`t convert userID to string")
+			return
+		}
+		bucket := 24 * time.Hour
+		switch v := r.URL.Query().Get("bucket"); v {
+		case "", "day":
+		case "hour":
+			bucket = time.Hour
+		default:
+			d, err := time.ParseDuration(v)
+			if err != nil || d < time.Minute {
+				writeProblem(w, r, http.StatusBadRequest, "bucket must be hour, day or a duration of at least 1m")
+				return
+			}
+			bucket = d
+		}
+		shortURL := chi.URLParam(r, "id")
+		stats, err := h.repo.GetLinkStats(r.Context(), userID, shortURL, bucket)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetEscapeHTML(false)
+		encoder.Encode(stats)
+	}
+}
+
 func (h *Handler) SaveBaseURL() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		userID := r.Context().Value("userID")
@@ -151,44 +262,83 @@ func (h *Handler) SaveBaseURL() http.HandlerFunc {
 		defer r.Body.Close()
 		err := decoder.Decode(&memory)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			log.Printf("Error decoding body: %v", err)
+			writeProblem(w, r, http.StatusBadRequest, "Error decoding body")
 			return
 		}
-		for _, i := range memory {
-			userIDvalue, ok := userID.(string)
-			if !ok {
-				http.Error(w, "userID in context not a string", http.StatusInternalServerError)
-				log.Printf("Error: userID in context not a string, %v", userID)
+		userIDvalue, ok := userID.(string)
+		if !ok {
+			writeProblem(w, r, http.StatusInternalServerError, "userID in context not a string")
+			log.Printf("Error: userID in context not a string, %v", userID)
+			return
+		}
+		raws := make([]string, len(memory))
+		for k, i := range memory {
+			raws[k] = i.Original_url
+		}
+		normalized, errs := h.validator.ValidateBatch(r.Context(), raws)
+		aliases := make(map[string]struct{})
+		now := time.Now()
+		for k, i := range memory {
+			if errs[k] != nil {
+				writeProblem(w, r, http.StatusBadRequest, fmt.Sprintf("correlation_id %s: %v", i.Correlation_id, errs[k]))
+				return
+			}
+			memory[k].Original_url = normalized[k]
+			if refuse(w, r, h.dest.check(r.Context(), memory[k].Original_url), fmt.Sprintf("correlation_id %s: ", i.Correlation_id)) {
 				return
 			}
-			newDBentry, err := pg.DbSavePrepare(userIDvalue, i, h.shortener)
+			memory[k].ExpiresAt, err = expiry(i.ExpiresAt, i.TTLSeconds, now)
 			if err != nil {
-				http.Error(w, "Error preparing DB entry ", http.StatusInternalServerError)
-				log.Printf("Error preparing DB entry: %v", err)
+				writeProblem(w, r, http.StatusBadRequest, fmt.Sprintf("correlation_id %s: %v", i.Correlation_id, err))
 				return
 			}
-			newDBvar = append(newDBvar, newDBentry)
-			clientRespSingle := model.ClientResponse{
-				Correlation_id: newDBentry.Correlation_id,
-				Short_url:      newDBentry.Short_url,
+			if i.Alias == "" {
+				continue
 			}
-			clientResponses = append(clientResponses, clientRespSingle)
+			aliasURL, err := h.shortener.Alias(i.Alias)
+			if err != nil {
+				writeProblem(w, r, http.StatusBadRequest, fmt.Sprintf("correlation_id %s: %v", i.Correlation_id, err))
+				return
+			}
+			aliases[aliasURL] = struct{}{}
 		}
-		pgRepo, ok := h.repo.(*pg.PostgresStorage)
-		if !ok {
-			http.Error(w, "Internal server error: storage type mismatch", http.StatusInternalServerError)
-			log.Printf("Error: storage backend is not PostgreSQL, batch save requires PostgreSQL")
+		status := http.StatusCreated
+		err = h.shortener.Retry(func() error {
+			newDBvar = newDBvar[:0]
+			for _, i := range memory {
+				newDBentry, err := h.prepareBatchEntry(r.Context(), userIDvalue, i)
+				if err != nil {
+					return err
+				}
+				newDBvar = append(newDBvar, newDBentry)
+			}
+			err := h.repo.SaveBatch(r.Context(), newDBvar)
+			var taken *storage.TakenError
+			if errors.As(err, &taken) {
+				if _, ok := aliases[taken.ShortURL]; ok {
+					// Retrying cannot help when a requested alias is taken.
+					return fmt.Errorf("%w: %s", shortener.ErrAliasTaken, h.links.ShortURL(r, taken.ShortURL))
+				}
+			}
+			return err
+		})
+		if errors.Is(err, shortener.ErrAliasTaken) {
+			writeProblem(w, r, http.StatusConflict, err.Error())
 			return
-		}
-		err = pgRepo.BaseSave(r.Context(), newDBvar)
-		if err != nil {
-			http.Error(w, "Internal server error during database operation", http.StatusInternalServerError)
-			log.Printf("Error saving batch to DB: %v", err)
+		} else if errors.Is(err, storage.ErrURLExists) {
+			status = http.StatusConflict
+		} else if err != nil {
+			writeError(w, r, err)
 			return
 		}
+		for _, saved := range newDBvar {
+			clientResponses = append(clientResponses, model.ClientResponse{
+				Correlation_id: saved.Correlation_id,
+				Short_url:      h.links.ShortURL(r, saved.Short_url),
+			})
+		}
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusCreated)
+		w.WriteHeader(status)
 		encoder := json.NewEncoder(w)
 		if err := encoder.Encode(clientResponses); err != nil {
 			log.Printf("Error encoding batch response: %v", err)
@@ -196,79 +346,96 @@ func (h *Handler) SaveBaseURL() http.HandlerFunc {
 	}
 }
 
+func (h *Handler) prepareBatchEntry(ctx context.Context, userID string, item model.Incoming) (model.DbSave, error) {
+	var shortURL string
+	var err error
+	if item.Alias != "" {
+		shortURL, err = h.shortener.Alias(item.Alias)
+	} else {
+		shortURL, err = h.shortener.Shorten(ctx, item.Original_url)
+	}
+	if err != nil {
+		return model.DbSave{}, err
+	}
+	return model.DbSave{
+		UserID:         userID,
+		Correlation_id: item.Correlation_id,
+		Original_url:   item.Original_url,
+		Short_url:      shortURL,
+		ExpiresAt:      item.ExpiresAt,
+	}, nil
+}
+
+// expiry turns the optional expires_at / ttl_seconds request fields into an
+// absolute expiry time; nil means the link never expires.
+func expiry(expiresAt *time.Time, ttlSeconds int64, now time.Time) (*time.Time, error) {
+	switch {
+	case expiresAt != nil && ttlSeconds != 0:
+		return nil, errors.New("expires_at and ttl_seconds are mutually exclusive")
+	case ttlSeconds < 0:
+		return nil, errors.New("ttl_seconds must be positive")
+	case ttlSeconds > 0:
+		at := now.Add(time.Duration(ttlSeconds) * time.Second)
+		return &at, nil
+	case expiresAt != nil && !expiresAt.After(now):
+		return nil, errors.New("expires_at must be in the future")
+	}
+	return expiresAt, nil
+}
+
 func (h *Handler) deleteBatch() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		userIDinter := r.Context().Value("userID")
 		if userIDinter == nil {
-			http.Error(w, "You don`t have userID to delete URL`s", http.StatusBadRequest)
+			writeProblem(w, r, http.StatusBadRequest, "You don`t have userID to delete URL`s")
 			return
 		}
 		userID, ok := userIDinter.(string)
 		if !ok {
-			http.Error(w, "Can`t convert userID to string", http.StatusInternalServerError)
+			writeProblem(w, r, http.StatusInternalServerError, "Can`t convert userID to string")
 			return
 		}
 		var incoming []string
-		ch := make(chan string)
 		decoder := json.NewDecoder(r.Body)
 		defer r.Body.Close()
 		err := decoder.Decode(&incoming)
 		if err != nil {
-			http.Error(w, "Error decoding body", http.StatusBadRequest)
+			writeProblem(w, r, http.StatusBadRequest, "Error decoding body")
+			return
+		}
+		for i := range incoming {
+			incoming[i] = codeFromInput(incoming[i])
+		}
+		jobID, err := h.deleter.Submit(userID, incoming)
+		if errors.Is(err, deleter.ErrQueueFull) || errors.Is(err, deleter.ErrPoolClosed) {
+			w.Header().Set("Retry-After", "1")
+			writeProblem(w, r, http.StatusServiceUnavailable, "Deletion queue is unavailable, try again later")
+			return
+		}
+		if err != nil {
+			writeProblem(w, r, http.StatusInternalServerError, "Error scheduling deletion")
+			log.Printf("Error scheduling deletion for user %s: %v", userID, err)
 			return
 		}
-		go func() {
-			defer close(ch)
-			for _, i := range incoming {
-				ch <- i
-			}
-		}()
-		go func() {
-			defer func() {
-				if r := recover(); r != nil {
-					log.Printf("PANIC in async batch delete for user %s: %v", userID, r)
-				}
-			}()
-			pgrepo, ok := h.repo.(*pg.PostgresStorage)
-			if !ok {
-				log.Printf("Error: storage backend is not PostgreSQL,batch delete requires PostgreSQL")
-				return
-			}
-			tx, err := pgrepo.DB.BeginTx(context.Background(), nil)
-			if err != nil {
-				log.Printf("Error: storage backend is not PostgreSQL,batch delete requires PostgreSQL")
-				return
-			}
-			defer tx.Rollback()
-			const maxBatchsize = 500
-			currentBatchSlice := make([]string, 0, maxBatchsize)
-			for ach := range ch {
-				currentBatchSlice = append(currentBatchSlice, ach)
-				if len(currentBatchSlice) == maxBatchsize {
-					err := pgrepo.DeleteURLs(userID, currentBatchSlice, tx)
-					if err != nil {
-						log.Printf("Batch Error - failed to call method DeleteURLs")
-						return
-					}
-					currentBatchSlice = make([]string, 0, maxBatchsize)
-				}
-			}
-			if len(currentBatchSlice) > 0 {
-				err := pgrepo.DeleteURLs(userID, currentBatchSlice, tx)
-				if err != nil {
-					log.Printf("Batch Error - failed for final delete")
-					return
-				}
-			}
-			err = tx.Commit()
-			if err != nil {
-				log.Printf("Batch Error - failed to commit transaction")
-				return
-			}
-			log.Printf("Batch delete completed succesfully")
-
-		}()
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"job_id": jobID})
+	}
+}
+
+func (h *Handler) deleteStatus() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := r.Context().Value("userID").(string)
+		if !ok {
+			writeProblem(w, r, http.StatusInternalServerError, "Can`t convert userID to string")
+			return
+		}
+		job, ok := h.deleter.Status(userID, chi.URLParam(r, "job"))
+		if !ok {
+			writeProblem(w, r, http.StatusNotFound, "Deletion job not found")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(job)
 	}
 }
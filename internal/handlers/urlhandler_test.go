@@ -111,3 +111,580 @@
 // }
 
 package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Polad20/urlshortener/internal/analytics"
+	"github.com/Polad20/urlshortener/internal/auth"
+	"github.com/Polad20/urlshortener/internal/deleter"
+	"github.com/Polad20/urlshortener/internal/middleware"
+	"github.com/Polad20/urlshortener/internal/model"
+	"github.com/Polad20/urlshortener/internal/policy"
+	"github.com/Polad20/urlshortener/internal/shortener"
+	"github.com/Polad20/urlshortener/internal/storage"
+	"github.com/Polad20/urlshortener/internal/storage/inmem"
+	"github.com/Polad20/urlshortener/internal/validation"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestServer(t *testing.T) (*httptest.Server, *inmem.Inmem) {
+	return newTestServerWithPolicy(t, Destinations{})
+}
+
+func newTestServerWithPolicy(t *testing.T, dest Destinations) (*httptest.Server, *inmem.Inmem) {
+	return newTestServerWithOptions(t, dest, Limits{})
+}
+
+func newTestServerWithOptions(t *testing.T, dest Destinations, limits Limits) (*httptest.Server, *inmem.Inmem) {
+	repo := inmem.NewInmem()
+	s, err := shortener.NewShortener(shortener.Options{
+		Charset: "abcdefghijklmnopqrstuvwxyz0123456789",
+		Length:  8,
+	}, nil)
+	require.NoError(t, err)
+	recorder := analytics.NewRecorder(repo, 100, 10, 10*time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	go recorder.Run(ctx)
+	pool := deleter.NewPool(repo, 2, 100, 10, 10*time.Millisecond)
+	pool.Start()
+	v, err := validation.New(validation.Options{BlockPrivate: true, OwnHosts: []string{"localhost"}, Shorteners: []string{"bit.ly"}})
+	require.NoError(t, err)
+	h := NewHandler(repo, s, v, auth.New([]byte("test-key"), auth.NewMemoryKeyStore()), recorder, pool, Links{BaseURL: "http://localhost:8080/"}, dest, limits)
+	ts := httptest.NewServer(h)
+	t.Cleanup(func() {
+		ts.Close()
+		cancel()
+		pool.Close(context.Background())
+	})
+	return ts, repo
+}
+
+func noRedirectClient() *http.Client {
+	jar, _ := cookiejar.New(nil)
+	return &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func TestRedirectHandler(t *testing.T) {
+	ctx := context.Background()
+	ts, repo := newTestServer(t)
+	require.NoError(t, repo.SaveURL(ctx, "creator", model.ShortenedURL{
+		ShortURL:    "abc",
+		OriginalURL: "https://example.com/page",
+	}))
+
+	tests := []struct {
+		name     string
+		path     string
+		status   int
+		location string
+	}{
+		{
+			name:     "Positive redirect without creator cookie",
+			path:     "/abc",
+			status:   http.StatusTemporaryRedirect,
+			location: "https://example.com/page",
+		},
+		{
+			name:   "Negative redirect - unknown code",
+			path:   "/nope",
+			status: http.StatusNotFound,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := noRedirectClient().Get(ts.URL + tc.path)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, tc.status, resp.StatusCode)
+			if tc.location != "" {
+				assert.Equal(t, tc.location, resp.Header.Get("Location"))
+			}
+		})
+	}
+}
+
+func TestBatchSaveAndDelete(t *testing.T) {
+	ts, _ := newTestServer(t)
+	client := noRedirectClient()
+
+	body := []byte(`[{"correlation_id":"1","original_url":"https://example.com/one"},{"correlation_id":"2","original_url":"https://example.com/two"}]`)
+	resp, err := client.Post(ts.URL+"/api/pg/shorten/batch", "application/json", bytes.NewBuffer(body))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var saved []model.ClientResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&saved))
+	require.Len(t, saved, 2)
+
+	code := strings.TrimPrefix(saved[0].Short_url, "http://localhost:8080/")
+	redirect, err := client.Get(ts.URL + "/" + code)
+	require.NoError(t, err)
+	redirect.Body.Close()
+	assert.Equal(t, http.StatusTemporaryRedirect, redirect.StatusCode)
+
+	toDelete, err := json.Marshal([]string{saved[0].Short_url})
+	require.NoError(t, err)
+	del, err := client.Post(ts.URL+"/api/user/urls", "application/json", bytes.NewBuffer(toDelete))
+	require.NoError(t, err)
+	defer del.Body.Close()
+	assert.Equal(t, http.StatusAccepted, del.StatusCode)
+	var accepted map[string]string
+	require.NoError(t, json.NewDecoder(del.Body).Decode(&accepted))
+	require.NotEmpty(t, accepted["job_id"])
+
+	assert.Eventually(t, func() bool {
+		resp, err := client.Get(ts.URL + "/api/user/urls/delete/" + accepted["job_id"])
+		if err != nil || resp.StatusCode != http.StatusOK {
+			return false
+		}
+		defer resp.Body.Close()
+		var job deleter.Job
+		return json.NewDecoder(resp.Body).Decode(&job) == nil && job.Status == deleter.StatusDone
+	}, time.Second, 10*time.Millisecond, "deletion job should finish")
+
+	other, err := noRedirectClient().Get(ts.URL + "/api/user/urls/delete/" + accepted["job_id"])
+	require.NoError(t, err)
+	other.Body.Close()
+	assert.Equal(t, http.StatusNotFound, other.StatusCode, "jobs are only visible to their owner")
+
+	assert.Eventually(t, func() bool {
+		resp, err := client.Get(ts.URL + "/" + code)
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusGone
+	}, time.Second, 10*time.Millisecond, "deleted short URL should answer 410 Gone")
+}
+
+func TestSaveURLConflict(t *testing.T) {
+	ts, _ := newTestServer(t)
+	client := noRedirectClient()
+
+	shorten := func(body string) (int, string) {
+		resp, err := client.Post(ts.URL+"/api/inmem/shorten", "application/json", bytes.NewBufferString(body))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		var result map[string]string
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		return resp.StatusCode, result["result"]
+	}
+
+	status, first := shorten(`{"url":"https://example.com/dup"}`)
+	require.Equal(t, http.StatusOK, status)
+	status, second := shorten(`{"url":"https://example.com/dup"}`)
+	assert.Equal(t, http.StatusConflict, status)
+	assert.Equal(t, first, second, "conflict should return the existing short URL")
+
+	body := []byte(`[{"correlation_id":"1","original_url":"https://example.com/dup"},{"correlation_id":"2","original_url":"https://example.com/fresh"}]`)
+	resp, err := client.Post(ts.URL+"/api/pg/shorten/batch", "application/json", bytes.NewBuffer(body))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	var saved []model.ClientResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&saved))
+	require.Len(t, saved, 2)
+	assert.Equal(t, first, saved[0].Short_url)
+	assert.NotEqual(t, first, saved[1].Short_url)
+}
+
+func TestSaveURLNormalization(t *testing.T) {
+	ts, _ := newTestServer(t)
+	client := noRedirectClient()
+
+	shorten := func(body string) (int, string) {
+		resp, err := client.Post(ts.URL+"/api/inmem/shorten", "application/json", bytes.NewBufferString(body))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		var result map[string]string
+		json.NewDecoder(resp.Body).Decode(&result)
+		return resp.StatusCode, result["result"]
+	}
+
+	status, first := shorten(`{"url":"https://example.com/norm"}`)
+	require.Equal(t, http.StatusOK, status)
+	status, second := shorten(`{"url":"HTTPS://Example.COM:443/norm"}`)
+	assert.Equal(t, http.StatusConflict, status, "spelling variants are the same link")
+	assert.Equal(t, first, second)
+
+	for _, url := range []string{"", "javascript:alert(1)", "/relative", "http://169.254.169.254/latest/meta-data/", "http://10.0.0.1/", "http://localhost:8080/abc", "https://bit.ly/x"} {
+		status, _ := shorten(`{"url":"` + url + `"}`)
+		assert.Equal(t, http.StatusBadRequest, status, url)
+	}
+
+	body := []byte(`[{"correlation_id":"1","original_url":"ftp://example.com/file"}]`)
+	resp, err := client.Post(ts.URL+"/api/pg/shorten/batch", "application/json", bytes.NewBuffer(body))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestSaveURLAlias(t *testing.T) {
+	ts, _ := newTestServer(t)
+	client := noRedirectClient()
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		result string
+	}{
+		{
+			name:   "Positive alias",
+			body:   `{"url":"https://example.com/vanity","alias":"vanity"}`,
+			status: http.StatusOK,
+			result: "http://localhost:8080/vanity",
+		},
+		{
+			name:   "Negative alias - taken",
+			body:   `{"url":"https://example.com/other","alias":"vanity"}`,
+			status: http.StatusConflict,
+		},
+		{
+			name:   "Negative alias - reserved",
+			body:   `{"url":"https://example.com/api","alias":"api"}`,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "Negative alias - outside charset",
+			body:   `{"url":"https://example.com/bad","alias":"bad/alias"}`,
+			status: http.StatusBadRequest,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := client.Post(ts.URL+"/api/inmem/shorten", "application/json", bytes.NewBufferString(tc.body))
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, tc.status, resp.StatusCode)
+			if tc.result != "" {
+				var result map[string]string
+				require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+				assert.Equal(t, tc.result, result["result"])
+			}
+		})
+	}
+
+	body := []byte(`[{"correlation_id":"1","original_url":"https://example.com/b1"},{"correlation_id":"2","original_url":"https://example.com/b2","alias":"vanity"}]`)
+	resp, err := client.Post(ts.URL+"/api/pg/shorten/batch", "application/json", bytes.NewBuffer(body))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusConflict, resp.StatusCode, "batch with a taken alias should answer 409")
+}
+
+func TestSaveURLExpiry(t *testing.T) {
+	ctx := context.Background()
+	ts, repo := newTestServer(t)
+	client := noRedirectClient()
+
+	resp, err := client.Post(ts.URL+"/api/inmem/shorten", "application/json",
+		bytes.NewBufferString(`{"url":"https://example.com/ttl","ttl_seconds":60}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = client.Post(ts.URL+"/api/inmem/shorten", "application/json",
+		bytes.NewBufferString(`{"url":"https://example.com/both","ttl_seconds":60,"expires_at":"2999-01-01T00:00:00Z"}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	past := time.Now().Add(-time.Second)
+	require.NoError(t, repo.SaveURL(ctx, "creator", model.ShortenedURL{
+		ShortURL:    "expired",
+		OriginalURL: "https://example.com/expired",
+		ExpiresAt:   &past,
+	}))
+	resp, err = client.Get(ts.URL + "/expired")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusGone, resp.StatusCode)
+}
+
+func TestLinkStats(t *testing.T) {
+	ts, _ := newTestServer(t)
+	owner := noRedirectClient()
+
+	resp, err := owner.Post(ts.URL+"/api/inmem/shorten", "application/json", bytes.NewBufferString(`{"url":"https://example.com/stats","alias":"stats"}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	for _, agent := range []string{"agent-a", "agent-a", "agent-b"} {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/stats", nil)
+		require.NoError(t, err)
+		req.Header.Set("User-Agent", agent)
+		resp, err := noRedirectClient().Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	}
+
+	var stats model.LinkStats
+	assert.Eventually(t, func() bool {
+		resp, err := owner.Get(ts.URL + "/api/user/urls/stats/stats?bucket=hour")
+		if err != nil || resp.StatusCode != http.StatusOK {
+			return false
+		}
+		defer resp.Body.Close()
+		if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+			return false
+		}
+		return stats.TotalClicks == 3
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int64(2), stats.UniqueVisitors)
+	var bucketed int64
+	for _, b := range stats.Histogram {
+		bucketed += b.Clicks
+	}
+	assert.Equal(t, int64(3), bucketed)
+
+	resp, err = noRedirectClient().Get(ts.URL + "/api/user/urls/stats/stats")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "stats are only visible to the link owner")
+}
+
+func TestLinksShortURL(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Forwarded-Host", "sho.rt")
+	req.Header.Set("X-Forwarded-Proto", "https")
+
+	links := Links{BaseURL: "http://localhost:8080"}
+	assert.Equal(t, "http://localhost:8080/abc", links.ShortURL(req, "abc"), "forwarded headers are ignored unless trusted")
+
+	links.TrustForwardedHost = true
+	assert.Equal(t, "https://sho.rt/abc", links.ShortURL(req, "abc"))
+}
+
+func TestWriteError(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+	}{
+		{name: "Not found", err: fmt.Errorf("lookup: %w", storage.ErrNotFound), status: http.StatusNotFound},
+		{name: "Deleted", err: storage.ErrDeleted, status: http.StatusGone},
+		{name: "Expired", err: storage.ErrExpired, status: http.StatusGone},
+		{name: "Conflict", err: &storage.ConflictError{ShortURL: "abc"}, status: http.StatusConflict},
+		{name: "Unavailable", err: storage.Classify(context.DeadlineExceeded), status: http.StatusServiceUnavailable},
+		{name: "Unknown", err: errors.New("boom"), status: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			writeError(w, httptest.NewRequest(http.MethodGet, "/abc", nil), tt.err)
+			assert.Equal(t, tt.status, w.Code)
+			assert.Equal(t, "application/problem+json", w.Header().Get("Content-Type"))
+			var body problem
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+			assert.Equal(t, tt.status, body.Status)
+			assert.Equal(t, "/abc", body.Instance)
+			assert.NotContains(t, body.Detail, "boom", "unclassified errors are not leaked")
+		})
+	}
+}
+
+type ruleChecker map[string]policy.Action
+
+func (c ruleChecker) Check(ctx context.Context, url string) (policy.Decision, error) {
+	return policy.Decision{Action: c[url]}, nil
+}
+
+func TestDestinationPolicy(t *testing.T) {
+	ctx := context.Background()
+	rules := ruleChecker{
+		"https://blocked.example/": policy.Block,
+		"https://legal.example/":   policy.Legal,
+	}
+	ts, repo := newTestServerWithPolicy(t, Destinations{Checker: rules, Interstitial: true})
+	client := noRedirectClient()
+
+	tests := []struct {
+		url    string
+		status int
+	}{
+		{"https://blocked.example/", http.StatusForbidden},
+		{"https://legal.example/", http.StatusUnavailableForLegalReasons},
+		{"https://fine.example/", http.StatusOK},
+	}
+	for _, tt := range tests {
+		resp, err := client.Post(ts.URL+"/api/inmem/shorten", "application/json", bytes.NewBufferString(`{"url":"`+tt.url+`"}`))
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, tt.status, resp.StatusCode, tt.url)
+	}
+
+	// Links saved before the rules changed are checked on redirect too.
+	require.NoError(t, repo.SaveURL(ctx, "creator", model.ShortenedURL{ShortURL: "late", OriginalURL: "https://blocked.example/"}))
+	require.NoError(t, repo.SaveURL(ctx, "creator", model.ShortenedURL{ShortURL: "warn", OriginalURL: "https://warn.example/"}))
+	resp, err := client.Get(ts.URL + "/late")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	rules["https://warn.example/"] = policy.Warn
+	resp, err = client.Get(ts.URL + "/warn")
+	require.NoError(t, err)
+	page, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(page), "/warn?confirm=1")
+
+	resp, err = client.Get(ts.URL + "/warn?confirm=1")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	assert.Equal(t, "https://warn.example/", resp.Header.Get("Location"))
+}
+
+func TestRateLimitedRoutes(t *testing.T) {
+	shorten, err := middleware.NewRateLimiter(middleware.NewMemoryStore(), "shorten", middleware.Rate{Limit: 1, Period: time.Minute}, middleware.ByUser)
+	require.NoError(t, err)
+	batch, err := middleware.NewRateLimiter(middleware.NewMemoryStore(), "batch", middleware.Rate{Limit: 1, Period: time.Minute}, middleware.ByUser)
+	require.NoError(t, err)
+	ts, _ := newTestServerWithOptions(t, Destinations{}, Limits{Shorten: shorten.Middleware, Batch: batch.Middleware})
+	client := noRedirectClient()
+
+	resp, err := client.Post(ts.URL+"/api/inmem/shorten", "application/json", bytes.NewBufferString(`{"url":"https://example.com/limited"}`))
+	require.NoError(t, err)
+	var result map[string]string
+	json.NewDecoder(resp.Body).Decode(&result)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "0", resp.Header.Get("RateLimit-Remaining"))
+
+	resp, err = client.Post(ts.URL+"/api/inmem/shorten", "application/json", bytes.NewBufferString(`{"url":"https://example.com/limited2"}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+
+	for i := 0; i < 3; i++ {
+		resp, err = client.Get(strings.Replace(result["result"], "http://localhost:8080", ts.URL, 1))
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode, "other routes have their own budgets")
+	}
+
+	for i := 0; i < 3; i++ {
+		resp, err = client.Post(ts.URL+"/api/user/urls", "application/json", bytes.NewBufferString(`["nope"]`))
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusAccepted, resp.StatusCode, "deletes do not spend the batch budget")
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	ts, _ := newTestServer(t)
+	client := noRedirectClient()
+
+	createKey := func(c *http.Client, token, body string) (*http.Response, map[string]any) {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/api/user/keys", bytes.NewBufferString(body))
+		require.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := c.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		var result map[string]any
+		json.NewDecoder(resp.Body).Decode(&result)
+		return resp, result
+	}
+	bearer := func(method, path, token, body string) *http.Response {
+		req, err := http.NewRequest(method, ts.URL+path, bytes.NewBufferString(body))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	resp, created := createKey(client, "", `{"name":"ci","scopes":["shorten","read"]}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	token, _ := created["key"].(string)
+	id, _ := created["id"].(string)
+	require.True(t, strings.HasPrefix(token, "usk_"+id+"_"), token)
+
+	resp = bearer(http.MethodPost, "/api/inmem/shorten", token, `{"url":"https://example.com/by-key"}`)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, resp.Cookies(), "API key requests get no session cookie")
+
+	// The key acts as the user that created it.
+	resp, err := client.Get(ts.URL + "/api/inmem/user/urls")
+	require.NoError(t, err)
+	var urls []map[string]any
+	json.NewDecoder(resp.Body).Decode(&urls)
+	resp.Body.Close()
+	require.Len(t, urls, 1)
+	assert.Equal(t, "https://example.com/by-key", urls[0]["original_url"])
+
+	resp = bearer(http.MethodPost, "/api/user/urls", token, `["abc"]`)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "the key has no delete scope")
+	resp = bearer(http.MethodGet, "/api/user/keys", token, "")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "the key cannot manage keys")
+
+	resp, _ = createKey(client, "", `{"scopes":["admin"]}`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, created = createKey(client, "", `{"name":"keys","scopes":["keys","read"]}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	keysToken, _ := created["key"].(string)
+	resp, _ = createKey(http.DefaultClient, keysToken, `{"scopes":["shorten"]}`)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "keys cannot grant scopes they lack")
+
+	resp = bearer(http.MethodGet, "/api/user/keys", keysToken, "")
+	var keys []map[string]any
+	json.NewDecoder(resp.Body).Decode(&keys)
+	resp.Body.Close()
+	require.Len(t, keys, 2)
+	assert.Equal(t, id, keys[0]["id"])
+	assert.NotNil(t, keys[0]["last_used_at"])
+	assert.Nil(t, keys[0]["key"], "tokens are never listed")
+
+	req, err := http.NewRequest(http.MethodDelete, ts.URL+"/api/user/keys/"+id, nil)
+	require.NoError(t, err)
+	resp, err = client.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp = bearer(http.MethodPost, "/api/inmem/shorten", token, `{"url":"https://example.com/revoked"}`)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("WWW-Authenticate"), "invalid_token")
+
+	resp = bearer(http.MethodGet, "/api/inmem/user/urls", token[:len(token)-1]+"x", "")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// Other users cannot revoke the key.
+	req, err = http.NewRequest(http.MethodDelete, ts.URL+"/api/user/keys/"+keys[1]["id"].(string), nil)
+	require.NoError(t, err)
+	resp, err = noRedirectClient().Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
@@ -0,0 +1,217 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rate is a token bucket of Limit tokens that refills completely in Period.
+type Rate struct {
+	Limit  int
+	Period time.Duration
+}
+
+func (r Rate) interval() time.Duration {
+	return r.Period / time.Duration(r.Limit)
+}
+
+// Result is the state of a bucket after a Take.
+type Result struct {
+	Allowed   bool
+	Remaining int
+	// Reset is the time until the bucket is full again.
+	Reset time.Duration
+	// RetryAfter is the time until the next token, set when not Allowed.
+	RetryAfter time.Duration
+}
+
+// Store keeps the buckets. Take spends one token of the bucket of key.
+type Store interface {
+	Take(ctx context.Context, key string, rate Rate) (Result, error)
+}
+
+// The buckets are kept in GCRA form: instead of a token count every key
+// stores the theoretical arrival time (TAT) at which its bucket would be
+// full again, which is a single number that is easy to share.
+func gcra(tat, now time.Time, rate Rate) (time.Time, Result) {
+	if tat.Before(now) {
+		tat = now
+	}
+	next := tat.Add(rate.interval())
+	if allowAt := next.Add(-rate.Period); now.Before(allowAt) {
+		return tat, Result{Reset: tat.Sub(now), RetryAfter: allowAt.Sub(now)}
+	}
+	return next, Result{Allowed: true, Remaining: remaining(next.Sub(now), rate), Reset: next.Sub(now)}
+}
+
+func remaining(reset time.Duration, rate Rate) int {
+	return int((rate.Period - reset) / rate.interval())
+}
+
+const sweepEvery = 1024
+
+// MemoryStore keeps the buckets of a single process.
+type MemoryStore struct {
+	mu    sync.Mutex
+	tats  map[string]time.Time
+	takes int
+	now   func() time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{tats: make(map[string]time.Time), now: time.Now}
+}
+
+func (s *MemoryStore) Take(ctx context.Context, key string, rate Rate) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	tat, result := gcra(s.tats[key], now, rate)
+	s.tats[key] = tat
+	if s.takes++; s.takes%sweepEvery == 0 {
+		for k, t := range s.tats {
+			if !t.After(now) {
+				delete(s.tats, k)
+			}
+		}
+	}
+	return result, nil
+}
+
+// KeyFunc returns the bucket key of a request, or false when the request
+// has no such key.
+type KeyFunc func(r *http.Request) (string, bool)
+
+// ByUser keys requests by the user ID set by the auth middleware.
+func ByUser(r *http.Request) (string, bool) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok || userID == "" {
+		return "", false
+	}
+	return "user:" + userID, true
+}
+
+// FirstOf keys requests by the first of keys the request has, e.g. by user
+// and by address when there is no user.
+func FirstOf(keys ...KeyFunc) KeyFunc {
+	return func(r *http.Request) (string, bool) {
+		for _, key := range keys {
+			if k, ok := key(r); ok {
+				return k, true
+			}
+		}
+		return "", false
+	}
+}
+
+// ByIP keys requests by client address, IPv6 clients by their /64. With
+// trustProxy the last X-Forwarded-For entry, the one added by our own
+// proxy, is used instead of the peer address.
+func ByIP(trustProxy bool) KeyFunc {
+	return func(r *http.Request) (string, bool) {
+		addr := r.RemoteAddr
+		if trustProxy {
+			if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+				last := forwarded[len(forwarded)-1]
+				addr = strings.TrimSpace(last[strings.LastIndexByte(last, ',')+1:])
+			}
+		}
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			addr = host
+		}
+		ip, err := netip.ParseAddr(addr)
+		if err != nil {
+			return "", false
+		}
+		ip = ip.Unmap().WithZone("")
+		if ip.Is6() {
+			return "ip:" + netip.PrefixFrom(ip, 64).Masked().String(), true
+		}
+		return "ip:" + ip.String(), true
+	}
+}
+
+// RateLimiter limits requests per key. A request has to get a token from
+// the bucket of every distinct key it has.
+type RateLimiter struct {
+	store Store
+	name  string
+	rate  Rate
+	keys  []KeyFunc
+}
+
+func NewRateLimiter(store Store, name string, rate Rate, keys ...KeyFunc) (*RateLimiter, error) {
+	if rate.Limit <= 0 || rate.Period <= 0 {
+		return nil, fmt.Errorf("rate limit %s: bad rate %d per %s", name, rate.Limit, rate.Period)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("rate limit %s: no keys", name)
+	}
+	return &RateLimiter{store: store, name: name, rate: rate, keys: keys}, nil
+}
+
+// Middleware answers 429 once a bucket is empty and reports the tightest
+// bucket in the RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset and
+// RateLimit-Policy headers. Store failures let the request through.
+func (l *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var tightest *Result
+		seen := make([]string, 0, len(l.keys))
+		for _, key := range l.keys {
+			k, ok := key(r)
+			if !ok || slices.Contains(seen, k) {
+				continue
+			}
+			seen = append(seen, k)
+			result, err := l.store.Take(r.Context(), l.name+":"+k, l.rate)
+			if err != nil {
+				log.Printf("Rate limit %s: %v", l.name, err)
+				continue
+			}
+			if tightest == nil || !result.Allowed || result.Remaining < tightest.Remaining {
+				tightest = &result
+			}
+			if !result.Allowed {
+				break
+			}
+		}
+		if tightest == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		header := w.Header()
+		header.Set("RateLimit-Limit", strconv.Itoa(l.rate.Limit))
+		header.Set("RateLimit-Remaining", strconv.Itoa(tightest.Remaining))
+		header.Set("RateLimit-Reset", seconds(tightest.Reset))
+		header.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%s", l.rate.Limit, seconds(l.rate.Period)))
+		if tightest.Allowed {
+			next.ServeHTTP(w, r)
+			return
+		}
+		header.Set("Retry-After", seconds(tightest.RetryAfter))
+		header.Set("Content-Type", "application/problem+json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(map[string]any{
+			"type":     "about:blank",
+			"title":    http.StatusText(http.StatusTooManyRequests),
+			"status":   http.StatusTooManyRequests,
+			"detail":   fmt.Sprintf("rate limit of %d requests per %s exceeded", l.rate.Limit, l.rate.Period),
+			"instance": r.URL.Path,
+		})
+	})
+}
+
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
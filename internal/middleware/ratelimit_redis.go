@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+)
+
+const rateLimitPrefix = "urlshortener:ratelimit:"
+
+// takeScript is gcra on a TAT kept in microseconds. It returns whether the
+// request is allowed, the TAT after it and, when refused, the microseconds
+// until the next token. The key expires once the bucket is full.
+var takeScript = goredis.NewScript(`
+local now = tonumber(ARGV[1])
+local interval = tonumber(ARGV[2])
+local period = tonumber(ARGV[3])
+local tat = tonumber(redis.call('GET', KEYS[1]) or now)
+if tat < now then tat = now end
+local next = tat + interval
+local allow_at = next - period
+if now < allow_at then return {0, tat, allow_at - now} end
+redis.call('SET', KEYS[1], next, 'PX', math.ceil((next - now) / 1000))
+return {1, next, 0}
+`)
+
+var errUnexpectedReply = errors.New("unexpected reply from redis")
+
+// RedisStore keeps the buckets in Redis so that every replica shares them.
+// The time comes from the replicas, whose clocks should be in sync.
+type RedisStore struct {
+	client *goredis.Client
+	now    func() time.Time
+}
+
+func NewRedisStore(client *goredis.Client) *RedisStore {
+	return &RedisStore{client: client, now: time.Now}
+}
+
+func (s *RedisStore) Take(ctx context.Context, key string, rate Rate) (Result, error) {
+	now := s.now()
+	res, err := takeScript.Run(ctx, s.client, []string{rateLimitPrefix + key},
+		now.UnixMicro(), rate.interval().Microseconds(), rate.Period.Microseconds()).Int64Slice()
+	if err != nil {
+		return Result{}, err
+	}
+	if len(res) != 3 {
+		return Result{}, errUnexpectedReply
+	}
+	reset := time.UnixMicro(res[1]).Sub(now)
+	if res[0] == 0 {
+		return Result{Reset: reset, RetryAfter: time.Duration(res[2]) * time.Microsecond}, nil
+	}
+	return Result{Allowed: true, Remaining: remaining(reset, rate), Reset: reset}, nil
+}
@@ -0,0 +1,183 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testStores(t *testing.T, now *time.Time) map[string]Store {
+	memory := NewMemoryStore()
+	memory.now = func() time.Time { return *now }
+	mr := miniredis.RunT(t)
+	client := goredis.NewClient(&goredis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	redis := NewRedisStore(client)
+	redis.now = func() time.Time { return *now }
+	return map[string]Store{"memory": memory, "redis": redis}
+}
+
+func TestStoreTake(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1700000000, 0)
+	rate := Rate{Limit: 3, Period: 3 * time.Second}
+	for name, store := range testStores(t, &now) {
+		t.Run(name, func(t *testing.T) {
+			key := name + "-key"
+			for i := 2; i >= 0; i-- {
+				res, err := store.Take(ctx, key, rate)
+				require.NoError(t, err)
+				assert.True(t, res.Allowed)
+				assert.Equal(t, i, res.Remaining)
+			}
+			res, err := store.Take(ctx, key, rate)
+			require.NoError(t, err)
+			assert.False(t, res.Allowed)
+			assert.Equal(t, 0, res.Remaining)
+			assert.Equal(t, time.Second, res.RetryAfter)
+			assert.Equal(t, 3*time.Second, res.Reset)
+
+			res, err = store.Take(ctx, "other-"+key, rate)
+			require.NoError(t, err)
+			assert.True(t, res.Allowed, "keys have separate buckets")
+
+			now = now.Add(time.Second)
+			res, err = store.Take(ctx, key, rate)
+			require.NoError(t, err)
+			assert.True(t, res.Allowed, "a token is back after one interval")
+			assert.Equal(t, 0, res.Remaining)
+
+			now = now.Add(10 * time.Second)
+			res, err = store.Take(ctx, key, rate)
+			require.NoError(t, err)
+			assert.Equal(t, 2, res.Remaining, "the bucket does not overfill")
+		})
+	}
+}
+
+func TestByIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		remote     string
+		forwarded  []string
+		trustProxy bool
+		want       string
+	}{
+		{name: "IPv4", remote: "203.0.113.7:1234", want: "ip:203.0.113.7"},
+		{name: "IPv6 prefix", remote: "[2001:db8::1]:1234", want: "ip:2001:db8::/64"},
+		{name: "Mapped IPv4", remote: "[::ffff:203.0.113.7]:1234", want: "ip:203.0.113.7"},
+		{name: "Untrusted forwarded", remote: "10.0.0.1:1234", forwarded: []string{"203.0.113.7"}, want: "ip:10.0.0.1"},
+		{name: "Trusted forwarded", remote: "10.0.0.1:1234", forwarded: []string{"198.51.100.1, 203.0.113.7"}, trustProxy: true, want: "ip:203.0.113.7"},
+		{name: "Last forwarded header", remote: "10.0.0.1:1234", forwarded: []string{"198.51.100.1", "203.0.113.8"}, trustProxy: true, want: "ip:203.0.113.8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remote
+			for _, f := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", f)
+			}
+			key, ok := ByIP(tt.trustProxy)(r)
+			require.True(t, ok)
+			assert.Equal(t, tt.want, key)
+		})
+	}
+}
+
+func TestRateLimiterMiddleware(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	store := NewMemoryStore()
+	store.now = func() time.Time { return now }
+	limiter, err := NewRateLimiter(store, "shorten", Rate{Limit: 2, Period: time.Minute}, ByUser, ByIP(false))
+	require.NoError(t, err)
+	handler := limiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	do := func(userID, remote string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/api/inmem/shorten", nil)
+		r.RemoteAddr = remote
+		if userID != "" {
+			r = r.WithContext(context.WithValue(r.Context(), "userID", userID))
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := do("alice", "203.0.113.1:1")
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "2", w.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "1", w.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "30", w.Header().Get("RateLimit-Reset"))
+	assert.Equal(t, "2;w=60", w.Header().Get("RateLimit-Policy"))
+
+	w = do("alice", "203.0.113.1:2")
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+
+	w = do("alice", "203.0.113.3:1")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code, "the user budget is spent from any address")
+	assert.Equal(t, "30", w.Header().Get("Retry-After"))
+	assert.Equal(t, "application/problem+json", w.Header().Get("Content-Type"))
+
+	w = do("bob", "203.0.113.1:1")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code, "the address budget is shared by its users")
+
+	w = do("", "203.0.113.4:1")
+	assert.Equal(t, http.StatusCreated, w.Code, "requests without a user are keyed by address only")
+
+	now = now.Add(30 * time.Second)
+	w = do("alice", "203.0.113.5:1")
+	assert.Equal(t, http.StatusCreated, w.Code)
+}
+
+func TestRateLimiterFallsBackToAddress(t *testing.T) {
+	store := NewMemoryStore()
+	byIP := ByIP(false)
+	limiter, err := NewRateLimiter(store, "shorten", Rate{Limit: 2, Period: time.Minute}, FirstOf(ByUser, byIP), byIP)
+	require.NoError(t, err)
+	handler := limiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	do := func(remote string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/api/inmem/shorten", nil)
+		r.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := do("203.0.113.1:1")
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "1", w.Header().Get("RateLimit-Remaining"), "the address bucket is taken from once")
+	assert.Equal(t, http.StatusCreated, do("203.0.113.1:2").Code)
+	assert.Equal(t, http.StatusTooManyRequests, do("203.0.113.1:3").Code, "requests without a user are limited by address")
+	assert.Equal(t, http.StatusCreated, do("203.0.113.2:1").Code)
+}
+
+type failingStore struct{}
+
+func (failingStore) Take(ctx context.Context, key string, rate Rate) (Result, error) {
+	return Result{}, context.DeadlineExceeded
+}
+
+func TestRateLimiterFailsOpen(t *testing.T) {
+	limiter, err := NewRateLimiter(failingStore{}, "redirect", Rate{Limit: 1, Period: time.Second}, ByIP(false))
+	require.NoError(t, err)
+	handler := limiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/abc", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, w.Header().Get("RateLimit-Limit"))
+	}
+}
@@ -1,15 +1,21 @@
 package model
 
+import "time"
+
 type Incoming struct {
-	Correlation_id string `json:"correlation_id"`
-	Original_url   string `json:"original_url"`
+	Correlation_id string     `json:"correlation_id"`
+	Original_url   string     `json:"original_url"`
+	Alias          string     `json:"alias,omitempty"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+	TTLSeconds     int64      `json:"ttl_seconds,omitempty"`
 }
 
 type DbSave struct {
-	UserID         string `db:"userID"`
-	Correlation_id string `db:"correlation_id"`
-	Original_url   string `db:"original_url"`
-	Short_url      string `db:"short_url"`
+	UserID         string     `db:"user_id"`
+	Correlation_id string     `db:"correlation_id"`
+	Original_url   string     `db:"original_url"`
+	Short_url      string     `db:"short_url"`
+	ExpiresAt      *time.Time `db:"expires_at"`
 }
 
 type ClientResponse struct {
@@ -0,0 +1,23 @@
+package model
+
+import "time"
+
+type Click struct {
+	ShortURL  string    `json:"short_url"`
+	Timestamp time.Time `json:"timestamp"`
+	Referrer  string    `json:"referrer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	ClientIP  string    `json:"client_ip,omitempty"`
+}
+
+type StatsBucket struct {
+	Start  time.Time `json:"start"`
+	Clicks int64     `json:"clicks"`
+}
+
+type LinkStats struct {
+	ShortURL       string        `json:"short_url"`
+	TotalClicks    int64         `json:"total_clicks"`
+	UniqueVisitors int64         `json:"unique_visitors"`
+	Histogram      []StatsBucket `json:"histogram"`
+}
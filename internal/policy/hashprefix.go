@@ -0,0 +1,132 @@
+package policy
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// HashPrefixDB is a local Safe-Browsing-style database of unsafe URL
+// expressions, stored as SHA-256 hashes indexed by their first four bytes.
+type HashPrefixDB interface {
+	// FullHashes returns the full hashes starting with prefix. Most lookups
+	// miss, and implementations are expected to answer those from memory.
+	FullHashes(ctx context.Context, prefix [4]byte) ([][sha256.Size]byte, error)
+}
+
+// HashPrefixChecker applies Action to URLs any of whose expressions is in
+// DB.
+type HashPrefixChecker struct {
+	DB     HashPrefixDB
+	Action Action
+	Name   string
+}
+
+func (c HashPrefixChecker) Check(ctx context.Context, raw string) (Decision, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return Decision{}, nil
+	}
+	for _, expr := range expressions(u) {
+		sum := sha256.Sum256([]byte(expr))
+		full, err := c.DB.FullHashes(ctx, [4]byte(sum[:4]))
+		if err != nil {
+			return Decision{}, err
+		}
+		for _, h := range full {
+			if h == sum {
+				return Decision{Action: c.Action, Reason: c.Name}, nil
+			}
+		}
+	}
+	return Decision{}, nil
+}
+
+// expressions returns the host suffix / path prefix combinations that
+// Safe Browsing looks up for u: the exact host plus up to four suffixes of
+// at most five components, times the exact path with and without query
+// plus up to four leading directories.
+func expressions(u *url.URL) []string {
+	host := strings.ToLower(u.Hostname())
+	hosts := []string{host}
+	if net.ParseIP(host) == nil {
+		parts := strings.Split(host, ".")
+		if len(parts) > 5 {
+			parts = parts[len(parts)-5:]
+		}
+		for i := 1; i < len(parts)-1 && len(hosts) < 5; i++ {
+			hosts = append(hosts, strings.Join(parts[i:], "."))
+		}
+	}
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	paths := []string{path}
+	if u.RawQuery != "" {
+		paths = append([]string{path + "?" + u.RawQuery}, paths...)
+	}
+	prefix := "/"
+	dirs := strings.Split(strings.Trim(path, "/"), "/")
+	for i := 0; i < len(dirs) && len(paths) < 6; i++ {
+		if prefix != path {
+			paths = append(paths, prefix)
+		}
+		prefix += dirs[i] + "/"
+	}
+	var exprs []string
+	for _, h := range hosts {
+		for _, p := range paths {
+			exprs = append(exprs, h+p)
+		}
+	}
+	return exprs
+}
+
+// MemoryHashDB keeps the whole database in memory.
+type MemoryHashDB map[[4]byte][][sha256.Size]byte
+
+// Add stores the hash of an URL expression such as evil.example/ or
+// evil.example/path/page.html.
+func (db MemoryHashDB) Add(expr string) {
+	db.addHash(sha256.Sum256([]byte(expr)))
+}
+
+func (db MemoryHashDB) addHash(sum [sha256.Size]byte) {
+	prefix := [4]byte(sum[:4])
+	db[prefix] = append(db[prefix], sum)
+}
+
+func (db MemoryHashDB) FullHashes(ctx context.Context, prefix [4]byte) ([][sha256.Size]byte, error) {
+	return db[prefix], nil
+}
+
+// LoadHashFile reads a MemoryHashDB from a file with one entry per line,
+// either a hex encoded SHA-256 hash or a plain URL expression.
+func LoadHashFile(path string) (MemoryHashDB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open hash database: %w", err)
+	}
+	defer f.Close()
+	db := make(MemoryHashDB)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if raw, err := hex.DecodeString(line); err == nil && len(raw) == sha256.Size {
+			db.addHash([sha256.Size]byte(raw))
+			continue
+		}
+		db.Add(line)
+	}
+	return db, scanner.Err()
+}
@@ -0,0 +1,68 @@
+package policy
+
+import (
+	"context"
+	"log"
+)
+
+// Action is what happens to a destination. Actions are ordered by severity;
+// when several checks disagree the most severe one wins.
+type Action int
+
+const (
+	Allow Action = iota
+	// Warn lets the link through but redirects via an interstitial page.
+	Warn
+	// Block refuses the link with 403 Forbidden.
+	Block
+	// Legal refuses the link with 451 Unavailable For Legal Reasons.
+	Legal
+)
+
+var actionNames = map[string]Action{
+	"allow": Allow,
+	"warn":  Warn,
+	"block": Block,
+	"legal": Legal,
+}
+
+func (a Action) String() string {
+	for name, action := range actionNames {
+		if action == a {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+type Decision struct {
+	Action Action
+	// Reason names the rule or list that matched.
+	Reason string
+}
+
+// Checker decides what to do with a destination URL. URLs are passed in
+// the canonical form produced by the validation package.
+type Checker interface {
+	Check(ctx context.Context, url string) (Decision, error)
+}
+
+// Chain runs every checker and returns the most severe decision. A checker
+// that fails is logged and skipped, so an unavailable list does not take
+// redirects down with it.
+type Chain []Checker
+
+func (c Chain) Check(ctx context.Context, url string) (Decision, error) {
+	var result Decision
+	for _, checker := range c {
+		d, err := checker.Check(ctx, url)
+		if err != nil {
+			log.Printf("Destination policy check failed for %s: %v", url, err)
+			continue
+		}
+		if d.Action > result.Action {
+			result = d
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,98 @@
+package policy
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testRules = `
+# phishing
+block domain evil.example
+legal domain court.example
+warn  regex  ^https://[^/]+/wp-login\.php
+allow domain safe.evil.example
+`
+
+func TestRules(t *testing.T) {
+	set, err := parseRules(strings.NewReader(testRules))
+	require.NoError(t, err)
+	tests := []struct {
+		url    string
+		action Action
+	}{
+		{"https://example.com/", Allow},
+		{"https://evil.example/login", Block},
+		{"https://www.evil.example/", Block},
+		{"https://notevil.example/", Allow},
+		{"https://safe.evil.example/", Allow},
+		{"https://court.example/", Legal},
+		{"https://blog.example/wp-login.php", Warn},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.action, set.check(tt.url).Action, tt.url)
+	}
+
+	set, err = parseRules(strings.NewReader("allow domain partner.example\ndefault block\n"))
+	require.NoError(t, err)
+	assert.Equal(t, Allow, set.check("https://partner.example/").Action)
+	assert.Equal(t, Block, set.check("https://other.example/").Action, "default block makes an allowlist")
+
+	_, err = parseRules(strings.NewReader("ban domain x.example"))
+	assert.Error(t, err)
+}
+
+func TestFileRulesReload(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "policy.txt")
+	require.NoError(t, os.WriteFile(path, []byte("block domain evil.example\n"), 0o600))
+	rules, err := LoadFileRules(path)
+	require.NoError(t, err)
+	d, _ := rules.Check(ctx, "https://evil.example/")
+	assert.Equal(t, Block, d.Action)
+
+	require.NoError(t, os.WriteFile(path, []byte("warn domain evil.example\n"), 0o600))
+	later := time.Now().Add(time.Second)
+	require.NoError(t, os.Chtimes(path, later, later))
+	reloaded, err := rules.Reload()
+	require.NoError(t, err)
+	assert.True(t, reloaded)
+	d, _ = rules.Check(ctx, "https://evil.example/")
+	assert.Equal(t, Warn, d.Action)
+
+	require.NoError(t, os.WriteFile(path, []byte("nonsense\n"), 0o600))
+	later = later.Add(time.Second)
+	require.NoError(t, os.Chtimes(path, later, later))
+	_, err = rules.Reload()
+	assert.Error(t, err)
+	d, _ = rules.Check(ctx, "https://evil.example/")
+	assert.Equal(t, Warn, d.Action, "a broken file keeps the previous rules")
+}
+
+func TestHashPrefixChecker(t *testing.T) {
+	db := make(MemoryHashDB)
+	db.Add("malware.example/")
+	db.Add("phish.example/bank/login.html")
+	chain := Chain{HashPrefixChecker{DB: db, Action: Block, Name: "hash list"}}
+	tests := []struct {
+		url    string
+		action Action
+	}{
+		{"https://malware.example/anything/here", Block},
+		{"https://a.b.malware.example/", Block},
+		{"https://phish.example/bank/login.html?x=1", Block},
+		{"https://phish.example/bank/", Allow},
+		{"https://example.com/", Allow},
+	}
+	for _, tt := range tests {
+		d, err := chain.Check(context.Background(), tt.url)
+		require.NoError(t, err)
+		assert.Equal(t, tt.action, d.Action, tt.url)
+	}
+}
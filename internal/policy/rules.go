@@ -0,0 +1,185 @@
+package policy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+type rule struct {
+	action Action
+	domain string
+	regex  *regexp.Regexp
+	line   int
+}
+
+func (r rule) matches(u *url.URL, raw string) bool {
+	if r.regex != nil {
+		return r.regex.MatchString(raw)
+	}
+	host := u.Hostname()
+	return host == r.domain || strings.HasSuffix(host, "."+r.domain)
+}
+
+type ruleSet struct {
+	rules []rule
+	// fallback applies when no rule matches; "default block" turns the
+	// allow rules into an allowlist.
+	fallback Action
+}
+
+// parseRules reads rules, one per line:
+//
+//	# comment
+//	block domain evil.example
+//	legal domain court-order.example
+//	warn  regex  ^https://[^/]+/wp-login\.php
+//	allow domain partner.example
+//	default allow
+//
+// Domain rules match the domain and its subdomains, regex rules the whole
+// canonical URL. Allow rules win over every other rule.
+func parseRules(r io.Reader) (ruleSet, error) {
+	set := ruleSet{fallback: Allow}
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		action, ok := actionNames[strings.ToLower(fields[0])]
+		if fields[0] == "default" && len(fields) == 2 {
+			action, ok = actionNames[strings.ToLower(fields[1])]
+			if !ok {
+				return set, fmt.Errorf("line %d: unknown action %q", lineNo, fields[1])
+			}
+			set.fallback = action
+			continue
+		}
+		if !ok {
+			return set, fmt.Errorf("line %d: unknown action %q", lineNo, fields[0])
+		}
+		if len(fields) != 3 {
+			return set, fmt.Errorf("line %d: expected <action> domain|regex <pattern>", lineNo)
+		}
+		r := rule{action: action, line: lineNo}
+		switch fields[1] {
+		case "domain":
+			r.domain = strings.ToLower(strings.TrimSuffix(fields[2], "."))
+		case "regex":
+			re, err := regexp.Compile(fields[2])
+			if err != nil {
+				return set, fmt.Errorf("line %d: %w", lineNo, err)
+			}
+			r.regex = re
+		default:
+			return set, fmt.Errorf("line %d: unknown rule kind %q", lineNo, fields[1])
+		}
+		set.rules = append(set.rules, r)
+	}
+	return set, scanner.Err()
+}
+
+func (s ruleSet) check(raw string) Decision {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return Decision{Action: s.fallback, Reason: "default rule"}
+	}
+	var result *rule
+	for i, r := range s.rules {
+		if !r.matches(u, raw) {
+			continue
+		}
+		if r.action == Allow {
+			return Decision{Action: Allow, Reason: fmt.Sprintf("rule on line %d", r.line)}
+		}
+		if result == nil || r.action > result.action {
+			result = &s.rules[i]
+		}
+	}
+	if result == nil {
+		return Decision{Action: s.fallback, Reason: "default rule"}
+	}
+	return Decision{Action: result.action, Reason: fmt.Sprintf("rule on line %d", result.line)}
+}
+
+// FileRules is a Checker backed by a rules file that is reloaded when it
+// changes. A file that fails to parse keeps the previous rules in force.
+type FileRules struct {
+	path string
+
+	lock    sync.RWMutex
+	rules   ruleSet
+	modTime time.Time
+}
+
+func LoadFileRules(path string) (*FileRules, error) {
+	f := &FileRules{path: path}
+	if _, err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *FileRules) Check(ctx context.Context, url string) (Decision, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return f.rules.check(url), nil
+}
+
+// Reload rereads the file if it changed since the last load.
+func (f *FileRules) Reload() (bool, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return false, fmt.Errorf("failed to stat policy file: %w", err)
+	}
+	f.lock.RLock()
+	unchanged := info.ModTime().Equal(f.modTime)
+	f.lock.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	file, err := os.Open(f.path)
+	if err != nil {
+		return false, fmt.Errorf("failed to open policy file: %w", err)
+	}
+	defer file.Close()
+	rules, err := parseRules(file)
+	if err != nil {
+		return false, fmt.Errorf("policy file %s: %w", f.path, err)
+	}
+	f.lock.Lock()
+	f.rules = rules
+	f.modTime = info.ModTime()
+	f.lock.Unlock()
+	return true, nil
+}
+
+// Watch checks the file for changes every interval until ctx is done.
+func (f *FileRules) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := f.Reload()
+			if err != nil {
+				log.Printf("Error reloading destination policy: %v", err)
+				continue
+			}
+			if reloaded {
+				log.Printf("Reloaded destination policy from %s", f.path)
+			}
+		}
+	}
+}
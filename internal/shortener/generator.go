@@ -0,0 +1,127 @@
+package shortener
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+
+	"github.com/speps/go-hashids/v2"
+)
+
+// Generator produces the code part of a short URL. length is the minimal
+// desired code length; strategies are free to ignore it when their codes are
+// unique by construction.
+type Generator interface {
+	Generate(ctx context.Context, originalURL string, length int) (string, error)
+}
+
+// Sequence hands out monotonically increasing identifiers for the
+// counter-based strategies.
+type Sequence interface {
+	NextID(ctx context.Context) (uint64, error)
+}
+
+// AtomicSequence is an in-process Sequence. It starts from zero on every
+// restart, so it only suits volatile storage.
+type AtomicSequence struct {
+	n atomic.Uint64
+}
+
+func (a *AtomicSequence) NextID(ctx context.Context) (uint64, error) {
+	return a.n.Add(1), nil
+}
+
+// RandomGenerator picks length random characters from charset.
+type RandomGenerator struct {
+	randomizer *rand.Rand
+	charset    string
+	lock       sync.Mutex
+}
+
+func NewRandomGenerator(charset string, seed int64) *RandomGenerator {
+	return &RandomGenerator{
+		randomizer: rand.New(rand.NewSource(seed)),
+		charset:    charset,
+	}
+}
+
+func (g *RandomGenerator) Generate(ctx context.Context, originalURL string, length int) (string, error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	b := make([]byte, length)
+	for i := range b {
+		b[i] = g.charset[g.randomizer.Intn(len(g.charset))]
+	}
+	return string(b), nil
+}
+
+// CounterGenerator encodes the next sequence value in base62, which gives the
+// shortest possible codes at the price of them being guessable.
+type CounterGenerator struct {
+	seq Sequence
+}
+
+func NewCounterGenerator(seq Sequence) *CounterGenerator {
+	return &CounterGenerator{seq: seq}
+}
+
+func (g *CounterGenerator) Generate(ctx context.Context, originalURL string, length int) (string, error) {
+	id, err := g.seq.NextID(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get next sequence value: %w", err)
+	}
+	return new(big.Int).SetUint64(id).Text(62), nil
+}
+
+// HashidsGenerator obfuscates sequence values with Hashids, so codes stay
+// short and unique but do not reveal how many links exist.
+type HashidsGenerator struct {
+	seq  Sequence
+	data hashids.HashIDData
+}
+
+// NewHashidsGenerator checks salt and alphabet up front, so that a bad
+// alphabet fails at startup instead of on every Generate.
+func NewHashidsGenerator(seq Sequence, salt, alphabet string) (*HashidsGenerator, error) {
+	data := hashids.NewData()
+	data.Salt = salt
+	if alphabet != "" {
+		data.Alphabet = alphabet
+	}
+	if _, err := hashids.NewWithData(data); err != nil {
+		return nil, fmt.Errorf("failed to set up hashids: %w", err)
+	}
+	return &HashidsGenerator{seq: seq, data: *data}, nil
+}
+
+func (g *HashidsGenerator) Generate(ctx context.Context, originalURL string, length int) (string, error) {
+	id, err := g.seq.NextID(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get next sequence value: %w", err)
+	}
+	data := g.data
+	data.MinLength = length
+	h, err := hashids.NewWithData(&data)
+	if err != nil {
+		return "", fmt.Errorf("failed to set up hashids: %w", err)
+	}
+	return h.EncodeInt64([]int64{int64(id)})
+}
+
+// HashGenerator derives the code from the SHA-256 of the original URL, so the
+// same URL always gets the same code. On collisions the caller grows length
+// and a longer prefix of the hash is used.
+type HashGenerator struct{}
+
+func (HashGenerator) Generate(ctx context.Context, originalURL string, length int) (string, error) {
+	sum := sha256.Sum256([]byte(originalURL))
+	code := new(big.Int).SetBytes(sum[:]).Text(62)
+	if length > len(code) {
+		return "", fmt.Errorf("hash code length %d exceeds %d characters", length, len(code))
+	}
+	return code[:length], nil
+}
@@ -1,36 +1,148 @@
 package shortener
 
 import (
-	"math/rand"
-	"os"
-	"strconv"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/Polad20/urlshortener/internal/storage"
+)
+
+const (
+	// maxAttempts bounds how many codes Retry tries before giving up.
+	maxAttempts = 8
+	// collisionsBeforeGrow is the number of collisions in a row after which
+	// the keyspace is considered crowded and codes get one character longer.
+	collisionsBeforeGrow = 3
+	maxURLLen            = 32
 )
 
+var (
+	ErrNoFreeShortURL = errors.New("could not generate a free short URL")
+	ErrInvalidAlias   = errors.New("invalid alias")
+	ErrAliasTaken     = errors.New("alias already taken")
+)
+
+// reservedAliases cannot be requested as custom codes because they clash
+// with service routes or are likely to confuse users.
+var reservedAliases = map[string]struct{}{
+	"api":    {},
+	"ping":   {},
+	"admin":  {},
+	"user":   {},
+	"health": {},
+	"static": {},
+}
+
 type Shortener struct {
-	OriginalURL string `json:"originalurl"`
-	ShortURL    string `json:"shorturl"`
-	randomizer  *rand.Rand
-	charset     string
-	urlLen      string
-	myDomain    string
+	generator  Generator
+	charset    string
+	urlLen     int
+	collisions int
+	lock       sync.Mutex
+}
+
+type Options struct {
+	// Strategy is one of random (default), counter, hashids or hash.
+	Strategy    string
+	Charset     string
+	Length      int
+	HashidsSalt string
+}
+
+// NewShortener builds a Shortener using the strategy named in opts. seq
+// backs the counter and hashids strategies; when nil an in-process
+// AtomicSequence is used.
+func NewShortener(opts Options, seq Sequence) (*Shortener, error) {
+	if seq == nil {
+		seq = &AtomicSequence{}
+	}
+	var generator Generator
+	switch opts.Strategy {
+	case "", "random":
+		generator = NewRandomGenerator(opts.Charset, time.Now().UnixNano())
+	case "counter":
+		generator = NewCounterGenerator(seq)
+	case "hashids":
+		g, err := NewHashidsGenerator(seq, opts.HashidsSalt, opts.Charset)
+		if err != nil {
+			return nil, err
+		}
+		generator = g
+	case "hash":
+		generator = HashGenerator{}
+	default:
+		return nil, fmt.Errorf("unknown short code strategy %q", opts.Strategy)
+	}
+	return New(generator, opts.Charset, opts.Length), nil
 }
 
-func NewShortener() *Shortener {
+func New(generator Generator, charset string, urlLen int) *Shortener {
 	return &Shortener{
-		randomizer: rand.New(rand.NewSource(time.Now().UnixNano())),
-		charset:    os.Getenv("CHARSET"),
-		urlLen:     os.Getenv("LENGTH"),
-		myDomain:   os.Getenv("DOMAIN"),
+		generator: generator,
+		charset:   charset,
+		urlLen:    urlLen,
 	}
 }
 
-func (s *Shortener) Shorten() string {
-	intlen, _ := strconv.Atoi(s.urlLen)
-	b := make([]byte, intlen)
-	for i := range b {
-		b[i] = s.charset[s.randomizer.Intn(len(s.charset))]
+// Shorten returns a new short code for originalURL. Codes are stored as is;
+// the public base URL is only added when rendering responses.
+func (s *Shortener) Shorten(ctx context.Context, originalURL string) (string, error) {
+	s.lock.Lock()
+	urlLen := s.urlLen
+	s.lock.Unlock()
+	return s.generator.Generate(ctx, originalURL, urlLen)
+}
+
+// Alias validates a user supplied code and returns it as the short code.
+// Whether the code is still free is up to storage to decide.
+func (s *Shortener) Alias(alias string) (string, error) {
+	if len(alias) == 0 || len(alias) > maxURLLen {
+		return "", fmt.Errorf("%w: length must be between 1 and %d", ErrInvalidAlias, maxURLLen)
+	}
+	for _, c := range alias {
+		if !strings.ContainsRune(s.charset, c) {
+			return "", fmt.Errorf("%w: character %q is not allowed", ErrInvalidAlias, c)
+		}
+	}
+	if _, ok := reservedAliases[strings.ToLower(alias)]; ok {
+		return "", fmt.Errorf("%w: %q is reserved", ErrInvalidAlias, alias)
+	}
+	return alias, nil
+}
+
+// Retry calls save until it stops failing with storage.ErrShortURLTaken,
+// at most maxAttempts times. save is expected to generate fresh codes with
+// Shorten on every call. Collisions in a row grow the code length.
+func (s *Shortener) Retry(save func() error) error {
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		err := save()
+		if !errors.Is(err, storage.ErrShortURLTaken) {
+			if err == nil {
+				s.resetCollisions()
+			}
+			return err
+		}
+		s.noteCollision()
+	}
+	return fmt.Errorf("%w after %d attempts", ErrNoFreeShortURL, maxAttempts)
+}
+
+func (s *Shortener) noteCollision() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.collisions++
+	if s.collisions >= collisionsBeforeGrow && s.urlLen < maxURLLen {
+		s.urlLen++
+		s.collisions = 0
 	}
-	shortURL := s.myDomain + string(b)
-	return shortURL
+}
+
+func (s *Shortener) resetCollisions() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.collisions = 0
 }
@@ -1,16 +1,83 @@
 package shortener
 
 import (
+	"context"
+	"strings"
 	"testing"
 
+	"github.com/Polad20/urlshortener/internal/storage"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
-var s *Shortener = NewShortener()
-
 func TestShorten(t *testing.T) {
+	s, err := NewShortener(Options{
+		Charset: "abcdefghijklmnopqrstuvwxyz",
+		Length:  10,
+	}, nil)
+	require.NoError(t, err)
 	ogURL := "https://stackoverflow.com/questions/22892120/how-to-generate-a-random-string-of-a-fixed-length-in-go"
-	s.OriginalURL = ogURL
-	s.Shorten()
-	assert.NotEqual(t, "", s.ShortURL)
+	code, err := s.Shorten(context.Background(), ogURL)
+	require.NoError(t, err)
+	assert.Len(t, code, 10)
+}
+
+func TestShortenerRejectsBadHashidsAlphabet(t *testing.T) {
+	_, err := NewShortener(Options{Strategy: "hashids", Charset: "abc", Length: 6}, nil)
+	assert.Error(t, err, "hashids needs at least 16 unique characters")
+}
+
+func TestGenerators(t *testing.T) {
+	ctx := context.Background()
+	ogURL := "https://example.com/page"
+
+	counter := NewCounterGenerator(&AtomicSequence{})
+	first, err := counter.Generate(ctx, ogURL, 6)
+	require.NoError(t, err)
+	second, err := counter.Generate(ctx, ogURL, 6)
+	require.NoError(t, err)
+	assert.Equal(t, "1", first)
+	assert.Equal(t, "2", second)
+
+	hashids, err := NewHashidsGenerator(&AtomicSequence{}, "salt", "")
+	require.NoError(t, err)
+	first, err = hashids.Generate(ctx, ogURL, 6)
+	require.NoError(t, err)
+	second, err = hashids.Generate(ctx, ogURL, 6)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, len(first), 6)
+	assert.NotEqual(t, first, second)
+
+	hash := HashGenerator{}
+	first, err = hash.Generate(ctx, ogURL, 7)
+	require.NoError(t, err)
+	second, err = hash.Generate(ctx, ogURL, 8)
+	require.NoError(t, err)
+	assert.Len(t, first, 7)
+	assert.True(t, strings.HasPrefix(second, first), "longer hash codes should extend shorter ones")
+}
+
+func TestRetry(t *testing.T) {
+	s := New(NewRandomGenerator("ab", 1), "ab", 1)
+	taken := map[string]bool{}
+	save := func(code string) error {
+		if taken[code] {
+			return storage.ErrShortURLTaken
+		}
+		taken[code] = true
+		return nil
+	}
+	for i := 0; i < 20; i++ {
+		err := s.Retry(func() error {
+			shortURL, err := s.Shorten(context.Background(), "https://example.com")
+			require.NoError(t, err)
+			return save(shortURL)
+		})
+		require.NoError(t, err)
+	}
+	assert.Len(t, taken, 20)
+	assert.Greater(t, s.urlLen, 1, "code length should grow once the keyspace fills up")
+
+	err := s.Retry(func() error { return storage.ErrShortURLTaken })
+	assert.ErrorIs(t, err, ErrNoFreeShortURL)
 }
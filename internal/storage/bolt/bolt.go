@@ -0,0 +1,521 @@
+package bolt
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/Polad20/urlshortener/internal/model"
+	"github.com/Polad20/urlshortener/internal/storage"
+	"go.etcd.io/bbolt"
+)
+
+// Buckets of the database. Users and clicks hold one nested bucket per user
+// and per short URL respectively.
+var (
+	bucketURLs        = []byte("urls")
+	bucketOriginals   = []byte("originals")
+	bucketUsers       = []byte("users")
+	bucketClicks      = []byte("clicks")
+	bucketClickCounts = []byte("click_counts")
+	bucketMeta        = []byte("meta")
+)
+
+// entry is the value stored under a short URL in the urls bucket.
+type entry struct {
+	UserID      string     `json:"user_id"`
+	OriginalURL string     `json:"original_url"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	Deleted     bool       `json:"deleted,omitempty"`
+}
+
+func (e entry) shortened(shortURL string) model.ShortenedURL {
+	return model.ShortenedURL{
+		ShortURL:    shortURL,
+		OriginalURL: e.OriginalURL,
+		ExpiresAt:   e.ExpiresAt,
+		IsDeleted:   e.Deleted,
+	}
+}
+
+type Storage struct {
+	db *bbolt.DB
+}
+
+func Open(path string) (*Storage, error) {
+	db, err := bbolt.Open(path, 0o600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bolt database: %w", err)
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{bucketURLs, bucketOriginals, bucketUsers, bucketClicks, bucketClickCounts, bucketMeta} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create bolt buckets: %w", err)
+	}
+	return &Storage{db: db}, nil
+}
+
+// update and view run fn in a transaction and report a closed or locked
+// database as storage.ErrUnavailable.
+func (s *Storage) update(fn func(tx *bbolt.Tx) error) error {
+	return classify(s.db.Update(fn))
+}
+
+func (s *Storage) view(fn func(tx *bbolt.Tx) error) error {
+	return classify(s.db.View(fn))
+}
+
+func classify(err error) error {
+	if errors.Is(err, bbolt.ErrDatabaseNotOpen) || errors.Is(err, bbolt.ErrTimeout) {
+		return fmt.Errorf("%w: %w", storage.ErrUnavailable, err)
+	}
+	return err
+}
+
+func getEntry(tx *bbolt.Tx, shortURL string) (entry, bool, error) {
+	var e entry
+	raw := tx.Bucket(bucketURLs).Get([]byte(shortURL))
+	if raw == nil {
+		return e, false, nil
+	}
+	if err := json.Unmarshal(raw, &e); err != nil {
+		return e, false, fmt.Errorf("corrupt entry for %s: %w", shortURL, err)
+	}
+	return e, true, nil
+}
+
+func putEntry(tx *bbolt.Tx, shortURL string, e entry) error {
+	raw, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucketURLs).Put([]byte(shortURL), raw)
+}
+
+// insert stores a new entry with its indexes. The caller has checked that
+// neither the short nor the original URL is taken.
+func insert(tx *bbolt.Tx, shortURL string, e entry) error {
+	if err := putEntry(tx, shortURL, e); err != nil {
+		return err
+	}
+	if err := tx.Bucket(bucketOriginals).Put([]byte(e.OriginalURL), []byte(shortURL)); err != nil {
+		return err
+	}
+	user, err := tx.Bucket(bucketUsers).CreateBucketIfNotExists([]byte(e.UserID))
+	if err != nil {
+		return err
+	}
+	return user.Put([]byte(shortURL), nil)
+}
+
+// liveCode returns the code stored for originalURL unless that link has
+// expired; expired links no longer hold their original URL.
+func liveCode(tx *bbolt.Tx, originalURL string, now time.Time) (string, bool, error) {
+	existing := tx.Bucket(bucketOriginals).Get([]byte(originalURL))
+	if existing == nil {
+		return "", false, nil
+	}
+	e, ok, err := getEntry(tx, string(existing))
+	if err != nil || !ok || e.shortened(string(existing)).Expired(now) {
+		return "", false, err
+	}
+	return string(existing), true, nil
+}
+
+func (s *Storage) SaveURL(ctx context.Context, userID string, url model.ShortenedURL) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.update(func(tx *bbolt.Tx) error {
+		existing, ok, err := liveCode(tx, url.OriginalURL, time.Now())
+		if err != nil {
+			return err
+		}
+		if ok {
+			return &storage.ConflictError{ShortURL: existing}
+		}
+		if tx.Bucket(bucketURLs).Get([]byte(url.ShortURL)) != nil {
+			return &storage.TakenError{ShortURL: url.ShortURL}
+		}
+		return insert(tx, url.ShortURL, entry{
+			UserID:      userID,
+			OriginalURL: url.OriginalURL,
+			ExpiresAt:   url.ExpiresAt,
+		})
+	})
+}
+
+// SaveBatch saves the whole batch in one transaction, so a taken short URL
+// leaves nothing behind.
+func (s *Storage) SaveBatch(ctx context.Context, urls []model.DbSave) error {
+	conflict := false
+	err := s.update(func(tx *bbolt.Tx) error {
+		conflict = false
+		now := time.Now()
+		for i, u := range urls {
+			existing, ok, err := liveCode(tx, u.Original_url, now)
+			if err != nil {
+				return err
+			}
+			if ok {
+				urls[i].Short_url = existing
+				conflict = true
+				continue
+			}
+			if tx.Bucket(bucketURLs).Get([]byte(u.Short_url)) != nil {
+				return &storage.TakenError{ShortURL: u.Short_url}
+			}
+			err = insert(tx, u.Short_url, entry{
+				UserID:      u.UserID,
+				OriginalURL: u.Original_url,
+				ExpiresAt:   u.ExpiresAt,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if conflict {
+		return storage.ErrURLExists
+	}
+	return nil
+}
+
+func (s *Storage) DeleteURLs(ctx context.Context, userID string, shortURLs []string) error {
+	return s.update(func(tx *bbolt.Tx) error {
+		user := tx.Bucket(bucketUsers).Bucket([]byte(userID))
+		if user == nil {
+			return nil
+		}
+		for _, shortURL := range shortURLs {
+			if user.Get([]byte(shortURL)) == nil {
+				continue
+			}
+			e, ok, err := getEntry(tx, shortURL)
+			if err != nil {
+				return err
+			}
+			if !ok || e.Deleted {
+				continue
+			}
+			e.Deleted = true
+			if err := putEntry(tx, shortURL, e); err != nil {
+				return err
+			}
+			originals := tx.Bucket(bucketOriginals)
+			if bytes.Equal(originals.Get([]byte(e.OriginalURL)), []byte(shortURL)) {
+				if err := originals.Delete([]byte(e.OriginalURL)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (s *Storage) GetURLsByUser(ctx context.Context, userID string) ([]model.ShortenedURL, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var urls []model.ShortenedURL
+	now := time.Now()
+	err := s.view(func(tx *bbolt.Tx) error {
+		user := tx.Bucket(bucketUsers).Bucket([]byte(userID))
+		if user == nil {
+			return nil
+		}
+		return user.ForEach(func(k, _ []byte) error {
+			e, ok, err := getEntry(tx, string(k))
+			if err != nil || !ok || e.Deleted || e.shortened(string(k)).Expired(now) {
+				return err
+			}
+			urls = append(urls, e.shortened(string(k)))
+			return nil
+		})
+	})
+	return urls, err
+}
+
+func (s *Storage) FindUsersOrigURL(ctx context.Context, userID, shortURL string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	var orig string
+	err := s.view(func(tx *bbolt.Tx) error {
+		e, ok, err := getEntry(tx, shortURL)
+		if err != nil {
+			return err
+		}
+		if !ok || e.UserID != userID {
+			return storage.ErrNotFound
+		}
+		orig = e.OriginalURL
+		return nil
+	})
+	return orig, err
+}
+
+func (s *Storage) FindOrigURL(ctx context.Context, shortURL string) (string, error) {
+	url, err := s.FindLink(ctx, shortURL)
+	return url.OriginalURL, err
+}
+
+func (s *Storage) FindLink(ctx context.Context, shortURL string) (model.ShortenedURL, error) {
+	if err := ctx.Err(); err != nil {
+		return model.ShortenedURL{}, err
+	}
+	var url model.ShortenedURL
+	err := s.view(func(tx *bbolt.Tx) error {
+		e, ok, err := getEntry(tx, shortURL)
+		if err != nil {
+			return err
+		}
+		switch {
+		case !ok:
+			return storage.ErrNotFound
+		case e.Deleted:
+			return storage.ErrDeleted
+		case e.shortened(shortURL).Expired(time.Now()):
+			return storage.ErrExpired
+		}
+		url = e.shortened(shortURL)
+		return nil
+	})
+	return url, err
+}
+
+// PurgeExpired drops expired links with their indexes and clicks, which
+// frees both the short code and the original URL for reuse.
+func (s *Storage) PurgeExpired(ctx context.Context) (int64, error) {
+	var purged int64
+	err := s.update(func(tx *bbolt.Tx) error {
+		purged = 0
+		now := time.Now()
+		var expired []string
+		err := tx.Bucket(bucketURLs).ForEach(func(k, v []byte) error {
+			var e entry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return fmt.Errorf("corrupt entry for %s: %w", k, err)
+			}
+			if e.shortened(string(k)).Expired(now) {
+				expired = append(expired, string(k))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, shortURL := range expired {
+			e, _, err := getEntry(tx, shortURL)
+			if err != nil {
+				return err
+			}
+			if err := tx.Bucket(bucketURLs).Delete([]byte(shortURL)); err != nil {
+				return err
+			}
+			originals := tx.Bucket(bucketOriginals)
+			if bytes.Equal(originals.Get([]byte(e.OriginalURL)), []byte(shortURL)) {
+				if err := originals.Delete([]byte(e.OriginalURL)); err != nil {
+					return err
+				}
+			}
+			if user := tx.Bucket(bucketUsers).Bucket([]byte(e.UserID)); user != nil {
+				if err := user.Delete([]byte(shortURL)); err != nil {
+					return err
+				}
+			}
+			if tx.Bucket(bucketClicks).Bucket([]byte(shortURL)) != nil {
+				if err := tx.Bucket(bucketClicks).DeleteBucket([]byte(shortURL)); err != nil {
+					return err
+				}
+			}
+			if err := tx.Bucket(bucketClickCounts).Delete([]byte(shortURL)); err != nil {
+				return err
+			}
+			purged++
+		}
+		return nil
+	})
+	return purged, err
+}
+
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+// SaveClicks appends clicks under their short URL and bumps the per-link
+// click counter in the same transaction.
+func (s *Storage) SaveClicks(ctx context.Context, clicks []model.Click) error {
+	return s.update(func(tx *bbolt.Tx) error {
+		counts := tx.Bucket(bucketClickCounts)
+		for _, c := range clicks {
+			bucket, err := tx.Bucket(bucketClicks).CreateBucketIfNotExists([]byte(c.ShortURL))
+			if err != nil {
+				return err
+			}
+			id, err := bucket.NextSequence()
+			if err != nil {
+				return err
+			}
+			raw, err := json.Marshal(c)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put(itob(id), raw); err != nil {
+				return err
+			}
+			var total uint64
+			if v := counts.Get([]byte(c.ShortURL)); v != nil {
+				total = binary.BigEndian.Uint64(v)
+			}
+			if err := counts.Put([]byte(c.ShortURL), itob(total+1)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *Storage) GetLinkStats(ctx context.Context, userID, shortURL string, bucket time.Duration) (model.LinkStats, error) {
+	stats := model.LinkStats{ShortURL: shortURL, Histogram: []model.StatsBucket{}}
+	err := s.view(func(tx *bbolt.Tx) error {
+		e, ok, err := getEntry(tx, shortURL)
+		if err != nil {
+			return err
+		}
+		if !ok || e.UserID != userID {
+			return storage.ErrNotFound
+		}
+		if v := tx.Bucket(bucketClickCounts).Get([]byte(shortURL)); v != nil {
+			stats.TotalClicks = int64(binary.BigEndian.Uint64(v))
+		}
+		clicks := tx.Bucket(bucketClicks).Bucket([]byte(shortURL))
+		if clicks == nil {
+			return nil
+		}
+		visitors := make(map[string]struct{})
+		buckets := make(map[time.Time]int64)
+		err = clicks.ForEach(func(_, v []byte) error {
+			var c model.Click
+			if err := json.Unmarshal(v, &c); err != nil {
+				return fmt.Errorf("corrupt click for %s: %w", shortURL, err)
+			}
+			visitors[c.ClientIP+"|"+c.UserAgent] = struct{}{}
+			buckets[c.Timestamp.UTC().Truncate(bucket)]++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		stats.UniqueVisitors = int64(len(visitors))
+		for start, clicks := range buckets {
+			stats.Histogram = append(stats.Histogram, model.StatsBucket{Start: start, Clicks: clicks})
+		}
+		return nil
+	})
+	if err != nil {
+		return model.LinkStats{}, err
+	}
+	sort.Slice(stats.Histogram, func(i, j int) bool {
+		return stats.Histogram[i].Start.Before(stats.Histogram[j].Start)
+	})
+	return stats, nil
+}
+
+// NextID makes the storage usable as a shortener.Sequence that survives
+// restarts.
+func (s *Storage) NextID(ctx context.Context) (uint64, error) {
+	var id uint64
+	err := s.update(func(tx *bbolt.Tx) error {
+		var err error
+		id, err = tx.Bucket(bucketMeta).NextSequence()
+		return err
+	})
+	return id, err
+}
+
+// Backup writes a consistent snapshot of the database to w while reads and
+// writes carry on.
+func (s *Storage) Backup(w io.Writer) (int64, error) {
+	var n int64
+	err := s.view(func(tx *bbolt.Tx) error {
+		var err error
+		n, err = tx.WriteTo(w)
+		return err
+	})
+	return n, err
+}
+
+// BackupToDir writes a snapshot into dir as urls-<timestamp>.db. The file
+// only gets its final name once it is completely written.
+func (s *Storage) BackupToDir(dir string) (string, error) {
+	name := filepath.Join(dir, "urls-"+time.Now().UTC().Format("20060102T150405Z")+".db")
+	tmp, err := os.CreateTemp(dir, ".backup-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create backup file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = s.Backup(tmp)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to write backup: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		return "", fmt.Errorf("failed to rename backup: %w", err)
+	}
+	return name, nil
+}
+
+// RunBackups snapshots s into dir every interval until ctx is done.
+func RunBackups(ctx context.Context, s *Storage, dir string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			name, err := s.BackupToDir(dir)
+			if err != nil {
+				log.Printf("Error backing up bolt database: %v", err)
+				continue
+			}
+			log.Printf("Backed up bolt database to %s", name)
+		}
+	}
+}
+
+func (s *Storage) Ping(ctx context.Context) error {
+	return s.view(func(tx *bbolt.Tx) error { return nil })
+}
+
+func (s *Storage) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,120 @@
+package bolt
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Polad20/urlshortener/internal/model"
+	"github.com/Polad20/urlshortener/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func openTestStorage(t *testing.T) *Storage {
+	s, err := Open(filepath.Join(t.TempDir(), "urls.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestSaveAndDelete(t *testing.T) {
+	ctx := context.Background()
+	s := openTestStorage(t)
+
+	require.NoError(t, s.SaveURL(ctx, "user1", model.ShortenedURL{ShortURL: "aaa", OriginalURL: "https://a.example"}))
+	var conflict *storage.ConflictError
+	require.ErrorAs(t, s.SaveURL(ctx, "user2", model.ShortenedURL{ShortURL: "xxx", OriginalURL: "https://a.example"}), &conflict)
+	assert.Equal(t, "aaa", conflict.ShortURL)
+	assert.ErrorIs(t, s.SaveURL(ctx, "user2", model.ShortenedURL{ShortURL: "aaa", OriginalURL: "https://x.example"}), storage.ErrShortURLTaken)
+
+	batch := []model.DbSave{
+		{UserID: "user1", Short_url: "bbb", Original_url: "https://b.example"},
+		{UserID: "user1", Short_url: "ccc", Original_url: "https://a.example"},
+	}
+	assert.ErrorIs(t, s.SaveBatch(ctx, batch), storage.ErrURLExists)
+	assert.Equal(t, "aaa", batch[1].Short_url)
+
+	err := s.SaveBatch(ctx, []model.DbSave{
+		{UserID: "user1", Short_url: "ddd", Original_url: "https://d.example"},
+		{UserID: "user1", Short_url: "bbb", Original_url: "https://e.example"},
+	})
+	assert.ErrorIs(t, err, storage.ErrShortURLTaken)
+	_, err = s.FindOrigURL(ctx, "ddd")
+	assert.ErrorIs(t, err, storage.ErrNotFound, "a failed batch must not be partially saved")
+
+	require.NoError(t, s.DeleteURLs(ctx, "user2", []string{"aaa"}))
+	orig, err := s.FindOrigURL(ctx, "aaa")
+	require.NoError(t, err)
+	assert.Equal(t, "https://a.example", orig)
+
+	require.NoError(t, s.DeleteURLs(ctx, "user1", []string{"aaa"}))
+	_, err = s.FindOrigURL(ctx, "aaa")
+	assert.ErrorIs(t, err, storage.ErrDeleted)
+	urls, err := s.GetURLsByUser(ctx, "user1")
+	require.NoError(t, err)
+	require.Len(t, urls, 1)
+	assert.Equal(t, "bbb", urls[0].ShortURL)
+
+	require.NoError(t, s.SaveURL(ctx, "user2", model.ShortenedURL{ShortURL: "fff", OriginalURL: "https://a.example"}),
+		"the original URL of a deleted link should be free to shorten again")
+	orig, err = s.FindOrigURL(ctx, "fff")
+	require.NoError(t, err)
+	assert.Equal(t, "https://a.example", orig)
+	_, err = s.FindOrigURL(ctx, "aaa")
+	assert.ErrorIs(t, err, storage.ErrDeleted)
+}
+
+func TestClicksAndBackup(t *testing.T) {
+	ctx := context.Background()
+	s := openTestStorage(t)
+	require.NoError(t, s.SaveURL(ctx, "user1", model.ShortenedURL{ShortURL: "aaa", OriginalURL: "https://a.example"}))
+	now := time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC)
+	require.NoError(t, s.SaveClicks(ctx, []model.Click{
+		{ShortURL: "aaa", Timestamp: now, ClientIP: "10.0.0.0", UserAgent: "a"},
+		{ShortURL: "aaa", Timestamp: now.Add(time.Hour), ClientIP: "10.0.0.0", UserAgent: "a"},
+		{ShortURL: "aaa", Timestamp: now.Add(time.Hour), ClientIP: "10.0.1.0", UserAgent: "a"},
+	}))
+
+	stats, err := s.GetLinkStats(ctx, "user1", "aaa", time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), stats.TotalClicks)
+	assert.Equal(t, int64(2), stats.UniqueVisitors)
+	assert.Len(t, stats.Histogram, 2)
+	_, err = s.GetLinkStats(ctx, "user2", "aaa", time.Hour)
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	name, err := s.BackupToDir(t.TempDir())
+	require.NoError(t, err)
+	restored, err := Open(name)
+	require.NoError(t, err)
+	defer restored.Close()
+	orig, err := restored.FindOrigURL(ctx, "aaa")
+	require.NoError(t, err)
+	assert.Equal(t, "https://a.example", orig)
+}
+
+func TestShortenAgainAfterExpiry(t *testing.T) {
+	ctx := context.Background()
+	s := openTestStorage(t)
+	past := time.Now().Add(-time.Minute)
+	require.NoError(t, s.SaveURL(ctx, "user1", model.ShortenedURL{ShortURL: "old", OriginalURL: "https://example.com/page", ExpiresAt: &past}))
+	urls, err := s.GetURLsByUser(ctx, "user1")
+	require.NoError(t, err)
+	assert.Empty(t, urls, "expired links are not listed")
+
+	require.NoError(t, s.SaveURL(ctx, "user2", model.ShortenedURL{ShortURL: "new", OriginalURL: "https://example.com/page"}),
+		"an expired link does not hold its original URL")
+	batch := []model.DbSave{{UserID: "user3", Short_url: "other", Original_url: "https://example.com/page"}}
+	assert.ErrorIs(t, s.SaveBatch(ctx, batch), storage.ErrURLExists)
+	assert.Equal(t, "new", batch[0].Short_url)
+	_, err = s.FindOrigURL(ctx, "old")
+	assert.ErrorIs(t, err, storage.ErrExpired)
+
+	_, err = s.PurgeExpired(ctx)
+	require.NoError(t, err)
+	var conflict *storage.ConflictError
+	require.ErrorAs(t, s.SaveURL(ctx, "user3", model.ShortenedURL{ShortURL: "third", OriginalURL: "https://example.com/page"}), &conflict)
+	assert.Equal(t, "new", conflict.ShortURL)
+}
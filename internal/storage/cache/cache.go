@@ -0,0 +1,182 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Polad20/urlshortener/internal/model"
+	"github.com/Polad20/urlshortener/internal/storage"
+)
+
+type Options struct {
+	// Size bounds the number of cached codes, hits and misses together.
+	Size int
+	// TTL is how long a resolved URL is served from the cache, at most
+	// until the link expires.
+	TTL time.Duration
+	// NegativeTTL is how long unknown, deleted and expired codes are
+	// remembered.
+	NegativeTTL time.Duration
+}
+
+type Stats struct {
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+	Size   int    `json:"size"`
+}
+
+type entry struct {
+	shortURL    string
+	originalURL string
+	expiresAt   *time.Time
+	// err is set for negative entries and is one of storage.ErrNotFound,
+	// storage.ErrDeleted or storage.ErrExpired.
+	err     error
+	expires time.Time
+}
+
+// Cache wraps a storage.Storage with an in-process LRU cache for redirect
+// lookups. Writes go to the wrapped storage and drop the codes they touch
+// from the cache.
+type Cache struct {
+	storage.Storage
+	opts Options
+	now  func() time.Time
+
+	lock    sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+func New(backend storage.Storage, opts Options) *Cache {
+	return &Cache{
+		Storage: backend,
+		opts:    opts,
+		now:     time.Now,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (c *Cache) FindOrigURL(ctx context.Context, shortURL string) (string, error) {
+	url, err := c.FindLink(ctx, shortURL)
+	return url.OriginalURL, err
+}
+
+func (c *Cache) FindLink(ctx context.Context, shortURL string) (model.ShortenedURL, error) {
+	if e, ok := c.get(shortURL); ok {
+		c.hits.Add(1)
+		if e.err != nil {
+			return model.ShortenedURL{}, e.err
+		}
+		return model.ShortenedURL{ShortURL: shortURL, OriginalURL: e.originalURL, ExpiresAt: e.expiresAt}, nil
+	}
+	c.misses.Add(1)
+	url, err := c.Storage.FindLink(ctx, shortURL)
+	switch {
+	case err == nil:
+		ttl := c.opts.TTL
+		if url.ExpiresAt != nil {
+			ttl = min(ttl, url.ExpiresAt.Sub(c.now()))
+		}
+		c.put(entry{shortURL: shortURL, originalURL: url.OriginalURL, expiresAt: url.ExpiresAt}, ttl)
+	case errors.Is(err, storage.ErrNotFound), errors.Is(err, storage.ErrDeleted), errors.Is(err, storage.ErrExpired):
+		c.put(entry{shortURL: shortURL, err: err}, c.opts.NegativeTTL)
+	}
+	return url, err
+}
+
+func (c *Cache) get(shortURL string) (entry, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	el, ok := c.entries[shortURL]
+	if !ok {
+		return entry{}, false
+	}
+	e := el.Value.(entry)
+	if !c.now().Before(e.expires) {
+		c.order.Remove(el)
+		delete(c.entries, shortURL)
+		return entry{}, false
+	}
+	c.order.MoveToFront(el)
+	return e, true
+}
+
+func (c *Cache) put(e entry, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e.expires = c.now().Add(ttl)
+	if el, ok := c.entries[e.shortURL]; ok {
+		el.Value = e
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[e.shortURL] = c.order.PushFront(e)
+	for c.order.Len() > c.opts.Size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(entry).shortURL)
+	}
+}
+
+func (c *Cache) invalidate(shortURLs ...string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, shortURL := range shortURLs {
+		if el, ok := c.entries[shortURL]; ok {
+			c.order.Remove(el)
+			delete(c.entries, shortURL)
+		}
+	}
+}
+
+// SaveURL drops the code from the cache, which may remember it as unknown.
+func (c *Cache) SaveURL(ctx context.Context, userID string, url model.ShortenedURL) error {
+	err := c.Storage.SaveURL(ctx, userID, url)
+	c.invalidate(url.ShortURL)
+	return err
+}
+
+func (c *Cache) SaveBatch(ctx context.Context, urls []model.DbSave) error {
+	shortURLs := make([]string, len(urls))
+	for i, u := range urls {
+		shortURLs[i] = u.Short_url
+	}
+	err := c.Storage.SaveBatch(ctx, urls)
+	c.invalidate(shortURLs...)
+	return err
+}
+
+func (c *Cache) DeleteURLs(ctx context.Context, userID string, shortURLs []string) error {
+	err := c.Storage.DeleteURLs(ctx, userID, shortURLs)
+	c.invalidate(shortURLs...)
+	return err
+}
+
+// PurgeExpired passes through to the wrapped storage so that the reaper
+// keeps running behind the cache.
+func (c *Cache) PurgeExpired(ctx context.Context) (int64, error) {
+	reaper, ok := c.Storage.(storage.Reaper)
+	if !ok {
+		return 0, nil
+	}
+	return reaper.PurgeExpired(ctx)
+}
+
+func (c *Cache) Stats() Stats {
+	c.lock.Lock()
+	size := c.order.Len()
+	c.lock.Unlock()
+	return Stats{Hits: c.hits.Load(), Misses: c.misses.Load(), Size: size}
+}
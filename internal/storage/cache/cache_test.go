@@ -0,0 +1,92 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Polad20/urlshortener/internal/model"
+	"github.com/Polad20/urlshortener/internal/storage"
+	"github.com/Polad20/urlshortener/internal/storage/inmem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type countingStorage struct {
+	*inmem.Inmem
+	lookups int
+}
+
+func (s *countingStorage) FindLink(ctx context.Context, shortURL string) (model.ShortenedURL, error) {
+	s.lookups++
+	return s.Inmem.FindLink(ctx, shortURL)
+}
+
+func TestCache(t *testing.T) {
+	ctx := context.Background()
+	backend := &countingStorage{Inmem: inmem.NewInmem()}
+	c := New(backend, Options{Size: 2, TTL: time.Minute, NegativeTTL: time.Second})
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	require.NoError(t, c.SaveURL(ctx, "user1", model.ShortenedURL{ShortURL: "aaa", OriginalURL: "https://a.example"}))
+	for i := 0; i < 3; i++ {
+		orig, err := c.FindOrigURL(ctx, "aaa")
+		require.NoError(t, err)
+		assert.Equal(t, "https://a.example", orig)
+	}
+	assert.Equal(t, 1, backend.lookups)
+	assert.Equal(t, Stats{Hits: 2, Misses: 1, Size: 1}, c.Stats())
+
+	_, err := c.FindOrigURL(ctx, "bbb")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	_, err = c.FindOrigURL(ctx, "bbb")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	assert.Equal(t, 2, backend.lookups, "misses are cached too")
+
+	require.NoError(t, c.SaveURL(ctx, "user1", model.ShortenedURL{ShortURL: "bbb", OriginalURL: "https://b.example"}))
+	orig, err := c.FindOrigURL(ctx, "bbb")
+	require.NoError(t, err)
+	assert.Equal(t, "https://b.example", orig, "saving a code drops its negative entry")
+
+	require.NoError(t, c.DeleteURLs(ctx, "user1", []string{"aaa"}))
+	_, err = c.FindOrigURL(ctx, "aaa")
+	assert.ErrorIs(t, err, storage.ErrDeleted)
+
+	now = now.Add(2 * time.Minute)
+	lookups := backend.lookups
+	_, err = c.FindOrigURL(ctx, "bbb")
+	require.NoError(t, err)
+	assert.Equal(t, lookups+1, backend.lookups, "expired entries are looked up again")
+}
+
+func TestCacheStopsAtLinkExpiry(t *testing.T) {
+	ctx := context.Background()
+	backend := &countingStorage{Inmem: inmem.NewInmem()}
+	c := New(backend, Options{Size: 2, TTL: time.Hour, NegativeTTL: time.Second})
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	expiresAt := now.Add(time.Minute)
+	require.NoError(t, c.SaveURL(ctx, "user1", model.ShortenedURL{ShortURL: "aaa", OriginalURL: "https://a.example", ExpiresAt: &expiresAt}))
+
+	_, err := c.FindOrigURL(ctx, "aaa")
+	require.NoError(t, err)
+	now = expiresAt
+	c.FindOrigURL(ctx, "aaa")
+	assert.Equal(t, 2, backend.lookups, "a link is not served from the cache past its expiry")
+}
+
+func TestCacheEviction(t *testing.T) {
+	ctx := context.Background()
+	backend := &countingStorage{Inmem: inmem.NewInmem()}
+	c := New(backend, Options{Size: 2, TTL: time.Minute, NegativeTTL: time.Minute})
+	for _, code := range []string{"a", "b", "a", "c"} {
+		c.FindOrigURL(ctx, code)
+	}
+	assert.Equal(t, 2, c.Stats().Size)
+	lookups := backend.lookups
+	c.FindOrigURL(ctx, "a")
+	assert.Equal(t, lookups, backend.lookups, "recently used code stays cached")
+	c.FindOrigURL(ctx, "b")
+	assert.Equal(t, lookups+1, backend.lookups, "least recently used code is evicted")
+}
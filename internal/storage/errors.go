@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// Error classes every backend reports through. Callers test for them with
+// errors.Is; the more specific errors below match their class too.
+var (
+	// ErrNotFound means the short URL is unknown, or not owned by the user
+	// asking for it.
+	ErrNotFound = errors.New("short URL not found")
+	// ErrGone means the short URL existed but no longer redirects.
+	ErrGone = errors.New("short URL gone")
+	// ErrConflict means a write clashes with stored data.
+	ErrConflict = errors.New("conflict with stored data")
+	// ErrUnavailable means the backend could not be reached or did not
+	// answer in time. Retrying later may succeed.
+	ErrUnavailable = errors.New("storage unavailable")
+)
+
+var (
+	ErrDeleted   error = &classError{"short URL deleted", ErrGone}
+	ErrExpired   error = &classError{"short URL expired", ErrGone}
+	ErrURLExists error = &classError{"original URL already shortened", ErrConflict}
+	// ErrShortURLTaken means the generated short URL collides with a stored
+	// one; callers are expected to retry with a new code.
+	ErrShortURLTaken error = &classError{"short URL already in use", ErrConflict}
+)
+
+// classError is a sentinel that also matches its error class.
+type classError struct {
+	msg   string
+	class error
+}
+
+func (e *classError) Error() string {
+	return e.msg
+}
+
+func (e *classError) Unwrap() error {
+	return e.class
+}
+
+// ConflictError is returned when the original URL is already stored.
+// It carries the short URL that was issued for it earlier and matches
+// ErrURLExists with errors.Is.
+type ConflictError struct {
+	ShortURL string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("original URL already shortened as %s", e.ShortURL)
+}
+
+func (e *ConflictError) Unwrap() error {
+	return ErrURLExists
+}
+
+// TakenError reports which short URL collided. It matches ErrShortURLTaken
+// with errors.Is.
+type TakenError struct {
+	ShortURL string
+}
+
+func (e *TakenError) Error() string {
+	return fmt.Sprintf("short URL %s already in use", e.ShortURL)
+}
+
+func (e *TakenError) Unwrap() error {
+	return ErrShortURLTaken
+}
+
+// Classify marks errors that mean the backend is unreachable or too slow,
+// so that they match ErrUnavailable. Other errors are returned as is.
+func Classify(err error) error {
+	if err == nil || errors.Is(err, ErrUnavailable) {
+		return err
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, driver.ErrBadConn) || errors.As(err, &netErr) {
+		return fmt.Errorf("%w: %w", ErrUnavailable, err)
+	}
+	return err
+}
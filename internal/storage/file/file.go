@@ -0,0 +1,420 @@
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Polad20/urlshortener/internal/model"
+	"github.com/Polad20/urlshortener/internal/storage"
+	"github.com/Polad20/urlshortener/internal/storage/inmem"
+)
+
+var errClosed = fmt.Errorf("storage file is closed: %w", storage.ErrUnavailable)
+
+type SyncPolicy string
+
+const (
+	// SyncAlways fsyncs after every write: nothing acknowledged is lost.
+	SyncAlways SyncPolicy = "always"
+	// SyncInterval fsyncs in the background every Options.SyncInterval.
+	SyncInterval SyncPolicy = "interval"
+	// SyncNever leaves flushing to the operating system.
+	SyncNever SyncPolicy = "never"
+)
+
+type Options struct {
+	Sync         SyncPolicy
+	SyncInterval time.Duration
+	// CompactInterval is how often the log is rewritten to hold only the
+	// current state. Zero disables compaction.
+	CompactInterval time.Duration
+}
+
+const (
+	opSave   = "save"
+	opDelete = "delete"
+	opClicks = "clicks"
+	opSeq    = "seq"
+	opPurge  = "purge"
+)
+
+// record is one line of the append-only log.
+type record struct {
+	Op        string              `json:"op"`
+	UserID    string              `json:"user_id,omitempty"`
+	URL       *model.ShortenedURL `json:"url,omitempty"`
+	Deleted   bool                `json:"deleted,omitempty"`
+	ShortURLs []string            `json:"short_urls,omitempty"`
+	Clicks    []model.Click       `json:"clicks,omitempty"`
+	Seq       uint64              `json:"seq,omitempty"`
+}
+
+// Storage keeps the working set in an inmem.Inmem and persists every change
+// to a JSON-lines log, which is replayed on startup.
+type Storage struct {
+	*inmem.Inmem
+	path string
+	opts Options
+
+	lock  sync.Mutex
+	file  *os.File
+	w     *bufio.Writer
+	seq   uint64
+	dirty bool
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func Open(path string, opts Options) (*Storage, error) {
+	switch opts.Sync {
+	case SyncAlways, SyncNever:
+	case SyncInterval:
+		if opts.SyncInterval <= 0 {
+			return nil, errors.New("sync interval must be positive")
+		}
+	default:
+		return nil, fmt.Errorf("unknown sync policy %q", opts.Sync)
+	}
+	s := &Storage{
+		Inmem: inmem.NewInmem(),
+		path:  path,
+		opts:  opts,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	if err := s.replay(); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open storage file: %w", err)
+	}
+	s.file = f
+	s.w = bufio.NewWriter(f)
+	go s.background()
+	return s, nil
+}
+
+// replay applies the log to the in-memory state. A torn last line, left by
+// a crash in the middle of a write, is cut off; damage anywhere else is an
+// error.
+func (s *Storage) replay() error {
+	f, err := os.Open(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open storage file: %w", err)
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	var good int64
+	for lineNo := 1; ; lineNo++ {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(bytes.TrimSpace(line)) > 0 {
+				log.Printf("Dropping incomplete last record of %s", s.path)
+				return os.Truncate(s.path, good)
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read storage file: %w", err)
+		}
+		var rec record
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return fmt.Errorf("storage file %s line %d: %w", s.path, lineNo, err)
+		}
+		if err := s.apply(rec); err != nil {
+			return fmt.Errorf("storage file %s line %d: %w", s.path, lineNo, err)
+		}
+		good += int64(len(line))
+	}
+}
+
+func (s *Storage) apply(rec record) error {
+	ctx := context.Background()
+	switch rec.Op {
+	case opSave:
+		if rec.URL == nil {
+			return errors.New("save record without url")
+		}
+		// Restoring the link already deleted keeps it from claiming its
+		// original URL, which a live link of another user may hold.
+		url := *rec.URL
+		url.IsDeleted = url.IsDeleted || rec.Deleted
+		s.Inmem.Restore(rec.UserID, url)
+	case opDelete:
+		return s.Inmem.DeleteURLs(ctx, rec.UserID, rec.ShortURLs)
+	case opClicks:
+		return s.Inmem.SaveClicks(ctx, rec.Clicks)
+	case opSeq:
+		s.seq = max(s.seq, rec.Seq)
+	case opPurge:
+		s.Inmem.Drop(rec.ShortURLs)
+	default:
+		return fmt.Errorf("unknown record op %q", rec.Op)
+	}
+	return nil
+}
+
+// write appends records to the log. The caller holds s.lock.
+func (s *Storage) write(records ...record) error {
+	if s.file == nil {
+		return errClosed
+	}
+	for _, rec := range records {
+		line, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		s.w.Write(line)
+		if err := s.w.WriteByte('\n'); err != nil {
+			return fmt.Errorf("failed to write storage file: %w", err)
+		}
+	}
+	if err := s.w.Flush(); err != nil {
+		return fmt.Errorf("failed to write storage file: %w", err)
+	}
+	switch s.opts.Sync {
+	case SyncAlways:
+		return s.file.Sync()
+	case SyncInterval:
+		s.dirty = true
+	}
+	return nil
+}
+
+func (s *Storage) SaveURL(ctx context.Context, userID string, url model.ShortenedURL) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.Inmem.SaveURL(ctx, userID, url); err != nil {
+		return err
+	}
+	if err := s.write(record{Op: opSave, UserID: userID, URL: &url}); err != nil {
+		s.Inmem.Forget(userID, url.ShortURL)
+		return err
+	}
+	return nil
+}
+
+func (s *Storage) SaveBatch(ctx context.Context, urls []model.DbSave) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	generated := make([]string, len(urls))
+	for i, u := range urls {
+		generated[i] = u.Short_url
+	}
+	err := s.Inmem.SaveBatch(ctx, urls)
+	if err != nil && !errors.Is(err, storage.ErrURLExists) {
+		return err
+	}
+	var records []record
+	for i, u := range urls {
+		// Conflicting entries got the existing short URL in place of ours.
+		if u.Short_url != generated[i] {
+			continue
+		}
+		records = append(records, record{Op: opSave, UserID: u.UserID, URL: &model.ShortenedURL{
+			ShortURL:    u.Short_url,
+			OriginalURL: u.Original_url,
+			ExpiresAt:   u.ExpiresAt,
+		}})
+	}
+	if len(records) > 0 {
+		if werr := s.write(records...); werr != nil {
+			for _, rec := range records {
+				s.Inmem.Forget(rec.UserID, rec.URL.ShortURL)
+			}
+			return werr
+		}
+	}
+	return err
+}
+
+func (s *Storage) DeleteURLs(ctx context.Context, userID string, shortURLs []string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.write(record{Op: opDelete, UserID: userID, ShortURLs: shortURLs}); err != nil {
+		return err
+	}
+	return s.Inmem.DeleteURLs(ctx, userID, shortURLs)
+}
+
+func (s *Storage) SaveClicks(ctx context.Context, clicks []model.Click) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.write(record{Op: opClicks, Clicks: clicks}); err != nil {
+		return err
+	}
+	return s.Inmem.SaveClicks(ctx, clicks)
+}
+
+// PurgeExpired drops expired links and logs their codes, so that they stay
+// gone after a restart even if a code is taken again.
+func (s *Storage) PurgeExpired(ctx context.Context) (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	codes := s.Inmem.ExpiredCodes(time.Now())
+	if len(codes) == 0 {
+		return 0, nil
+	}
+	if err := s.write(record{Op: opPurge, ShortURLs: codes}); err != nil {
+		return 0, err
+	}
+	return s.Inmem.Drop(codes), nil
+}
+
+// NextID makes the storage usable as a shortener.Sequence that survives
+// restarts.
+func (s *Storage) NextID(ctx context.Context) (uint64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.write(record{Op: opSeq, Seq: s.seq + 1}); err != nil {
+		return 0, err
+	}
+	s.seq++
+	return s.seq, nil
+}
+
+// Compact rewrites the log so it holds one record per stored URL, one per
+// click batch and the sequence, dropping superseded and purged entries.
+func (s *Storage) Compact() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.file == nil {
+		return errClosed
+	}
+	tmpPath := s.path + ".compact"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create compaction file: %w", err)
+	}
+	defer os.Remove(tmpPath)
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	var encErr error
+	encode := func(rec record) {
+		if encErr == nil {
+			encErr = enc.Encode(rec)
+		}
+	}
+	var clicks []model.Click
+	s.Inmem.Each(func(userID string, url model.ShortenedURL) {
+		encode(record{Op: opSave, UserID: userID, URL: &url, Deleted: url.IsDeleted})
+	}, func(click model.Click) {
+		clicks = append(clicks, click)
+	})
+	const clicksPerRecord = 1000
+	for start := 0; start < len(clicks); start += clicksPerRecord {
+		encode(record{Op: opClicks, Clicks: clicks[start:min(start+clicksPerRecord, len(clicks))]})
+	}
+	if s.seq > 0 {
+		encode(record{Op: opSeq, Seq: s.seq})
+	}
+	if encErr == nil {
+		encErr = w.Flush()
+	}
+	if encErr == nil {
+		encErr = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); encErr == nil {
+		encErr = closeErr
+	}
+	if encErr != nil {
+		return fmt.Errorf("failed to write compaction file: %w", encErr)
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return fmt.Errorf("failed to replace storage file: %w", err)
+	}
+	if dir, err := os.Open(filepath.Dir(s.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to reopen storage file: %w", err)
+	}
+	s.file.Close()
+	s.file = f
+	s.w = bufio.NewWriter(f)
+	s.dirty = false
+	return nil
+}
+
+func (s *Storage) background() {
+	defer close(s.done)
+	var syncTick, compactTick <-chan time.Time
+	if s.opts.Sync == SyncInterval {
+		t := time.NewTicker(s.opts.SyncInterval)
+		defer t.Stop()
+		syncTick = t.C
+	}
+	if s.opts.CompactInterval > 0 {
+		t := time.NewTicker(s.opts.CompactInterval)
+		defer t.Stop()
+		compactTick = t.C
+	}
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-syncTick:
+			s.lock.Lock()
+			if s.dirty && s.file != nil {
+				if err := s.file.Sync(); err != nil {
+					log.Printf("Error syncing storage file: %v", err)
+				}
+				s.dirty = false
+			}
+			s.lock.Unlock()
+		case <-compactTick:
+			if err := s.Compact(); err != nil {
+				log.Printf("Error compacting storage file: %v", err)
+			}
+		}
+	}
+}
+
+func (s *Storage) Ping(ctx context.Context) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.file == nil {
+		return errClosed
+	}
+	return nil
+}
+
+// Close stops the background work and closes the log. Calling it again
+// returns the result of the first call.
+func (s *Storage) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+		<-s.done
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		err := s.w.Flush()
+		if syncErr := s.file.Sync(); err == nil {
+			err = syncErr
+		}
+		if closeErr := s.file.Close(); err == nil {
+			err = closeErr
+		}
+		s.file = nil
+		s.closeErr = err
+	})
+	return s.closeErr
+}
@@ -0,0 +1,180 @@
+package file
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Polad20/urlshortener/internal/model"
+	"github.com/Polad20/urlshortener/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func openTestStorage(t *testing.T, path string) *Storage {
+	s, err := Open(path, Options{Sync: SyncAlways})
+	require.NoError(t, err)
+	return s
+}
+
+func TestReplay(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "urls.jsonl")
+
+	s := openTestStorage(t, path)
+	require.NoError(t, s.SaveURL(ctx, "user1", model.ShortenedURL{ShortURL: "aaa", OriginalURL: "https://a.example"}))
+	err := s.SaveBatch(ctx, []model.DbSave{
+		{UserID: "user1", Short_url: "bbb", Original_url: "https://b.example"},
+		{UserID: "user1", Short_url: "ccc", Original_url: "https://a.example"},
+	})
+	assert.ErrorIs(t, err, storage.ErrURLExists)
+	require.NoError(t, s.DeleteURLs(ctx, "user1", []string{"bbb"}))
+	require.NoError(t, s.SaveClicks(ctx, []model.Click{{ShortURL: "aaa", Timestamp: time.Now(), ClientIP: "10.0.0.0"}}))
+	id, err := s.NextID(ctx)
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	for _, compact := range []bool{false, true} {
+		s = openTestStorage(t, path)
+		orig, err := s.FindOrigURL(ctx, "aaa")
+		require.NoError(t, err)
+		assert.Equal(t, "https://a.example", orig)
+		_, err = s.FindOrigURL(ctx, "bbb")
+		assert.ErrorIs(t, err, storage.ErrDeleted)
+		_, err = s.FindOrigURL(ctx, "ccc")
+		assert.ErrorIs(t, err, storage.ErrNotFound)
+		stats, err := s.GetLinkStats(ctx, "user1", "aaa", time.Hour)
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), stats.TotalClicks)
+		next, err := s.NextID(ctx)
+		require.NoError(t, err)
+		assert.Greater(t, next, id)
+		id = next
+		if compact {
+			require.NoError(t, s.Compact())
+		}
+		require.NoError(t, s.Close())
+	}
+}
+
+func TestReplayTornTail(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "urls.jsonl")
+	s := openTestStorage(t, path)
+	require.NoError(t, s.SaveURL(ctx, "user1", model.ShortenedURL{ShortURL: "aaa", OriginalURL: "https://a.example"}))
+	require.NoError(t, s.Close())
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"op":"save","user_id":"us`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	s = openTestStorage(t, path)
+	defer s.Close()
+	orig, err := s.FindOrigURL(ctx, "aaa")
+	require.NoError(t, err)
+	assert.Equal(t, "https://a.example", orig)
+	require.NoError(t, s.SaveURL(ctx, "user1", model.ShortenedURL{ShortURL: "bbb", OriginalURL: "https://b.example"}))
+}
+
+func TestCompactKeepsLiveOriginal(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "urls.jsonl")
+	past := time.Now().Add(-time.Hour)
+
+	s := openTestStorage(t, path)
+	require.NoError(t, s.SaveURL(ctx, "user3", model.ShortenedURL{ShortURL: "ccc", OriginalURL: "https://a.example", ExpiresAt: &past}))
+	require.NoError(t, s.SaveURL(ctx, "user1", model.ShortenedURL{ShortURL: "aaa", OriginalURL: "https://a.example"}))
+	require.NoError(t, s.DeleteURLs(ctx, "user1", []string{"aaa"}))
+	require.NoError(t, s.SaveURL(ctx, "user2", model.ShortenedURL{ShortURL: "bbb", OriginalURL: "https://a.example"}))
+
+	// Compaction writes links in map order, so go round several times for
+	// the deleted and expired copies to land after the live one.
+	for i := 0; i < 10; i++ {
+		require.NoError(t, s.Compact())
+		require.NoError(t, s.Close())
+		s = openTestStorage(t, path)
+
+		_, err := s.FindOrigURL(ctx, "aaa")
+		assert.ErrorIs(t, err, storage.ErrDeleted)
+		err = s.SaveURL(ctx, "user4", model.ShortenedURL{ShortURL: "ddd", OriginalURL: "https://a.example"})
+		var conflict *storage.ConflictError
+		require.ErrorAs(t, err, &conflict, "round %d", i)
+		assert.Equal(t, "bbb", conflict.ShortURL)
+	}
+	require.NoError(t, s.Close())
+}
+
+func TestPurgeSurvivesReopen(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "urls.jsonl")
+	past := time.Now().Add(-time.Hour)
+
+	s := openTestStorage(t, path)
+	require.NoError(t, s.SaveURL(ctx, "user1", model.ShortenedURL{ShortURL: "aaa", OriginalURL: "https://a.example", ExpiresAt: &past}))
+	require.NoError(t, s.SaveClicks(ctx, []model.Click{{ShortURL: "aaa", Timestamp: time.Now()}}))
+	purged, err := s.PurgeExpired(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), purged)
+	require.NoError(t, s.SaveURL(ctx, "user2", model.ShortenedURL{ShortURL: "aaa", OriginalURL: "https://b.example"}))
+	require.NoError(t, s.Close())
+
+	s = openTestStorage(t, path)
+	defer s.Close()
+	orig, err := s.FindOrigURL(ctx, "aaa")
+	require.NoError(t, err)
+	assert.Equal(t, "https://b.example", orig)
+	stats, err := s.GetLinkStats(ctx, "user2", "aaa", time.Hour)
+	require.NoError(t, err)
+	assert.Zero(t, stats.TotalClicks)
+
+	purged, err = s.PurgeExpired(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, purged)
+	_, err = s.FindOrigURL(ctx, "aaa")
+	assert.NoError(t, err)
+}
+
+func TestFailedWriteLeavesMemoryUnchanged(t *testing.T) {
+	ctx := context.Background()
+	s := openTestStorage(t, filepath.Join(t.TempDir(), "urls.jsonl"))
+	require.NoError(t, s.SaveURL(ctx, "user1", model.ShortenedURL{ShortURL: "aaa", OriginalURL: "https://a.example"}))
+	// Writes to the log fail from now on.
+	require.NoError(t, s.file.Close())
+
+	assert.Error(t, s.SaveURL(ctx, "user1", model.ShortenedURL{ShortURL: "bbb", OriginalURL: "https://b.example"}))
+	_, err := s.FindOrigURL(ctx, "bbb")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	assert.Error(t, s.SaveBatch(ctx, []model.DbSave{{UserID: "user1", Short_url: "ccc", Original_url: "https://c.example"}}))
+	_, err = s.FindOrigURL(ctx, "ccc")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	assert.Error(t, s.DeleteURLs(ctx, "user1", []string{"aaa"}))
+	orig, err := s.FindOrigURL(ctx, "aaa")
+	require.NoError(t, err)
+	assert.Equal(t, "https://a.example", orig)
+
+	assert.Error(t, s.SaveClicks(ctx, []model.Click{{ShortURL: "aaa", Timestamp: time.Now()}}))
+	stats, err := s.GetLinkStats(ctx, "user1", "aaa", time.Hour)
+	require.NoError(t, err)
+	assert.Zero(t, stats.TotalClicks)
+}
+
+func TestConcurrentClose(t *testing.T) {
+	s := openTestStorage(t, filepath.Join(t.TempDir(), "urls.jsonl"))
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, s.Close())
+		}()
+	}
+	wg.Wait()
+	assert.ErrorIs(t, s.Ping(context.Background()), errClosed)
+}
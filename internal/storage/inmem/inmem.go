@@ -4,61 +4,315 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/Polad20/urlshortener/internal/model"
+	"github.com/Polad20/urlshortener/internal/storage"
 )
 
 type Inmem struct {
-	urlList map[string][]model.ShortenedURL
-	lock    sync.Mutex
+	urlList   map[string][]model.ShortenedURL
+	owners    map[string]string
+	originals map[string]string
+	clicks    map[string][]model.Click
+	lock      sync.Mutex
 }
 
 func NewInmem() *Inmem {
 	memstor := &Inmem{}
 	memstor.urlList = make(map[string][]model.ShortenedURL)
+	memstor.owners = make(map[string]string)
+	memstor.originals = make(map[string]string)
+	memstor.clicks = make(map[string][]model.Click)
 	return memstor
 }
 
-func (storage *Inmem) SaveURL(userID, shortURL, originalURL string) error {
-	storage.lock.Lock()
-	defer storage.lock.Unlock()
-	log.Printf("Saving URL for user %s: shortURL='%s', originalURL='%s'", userID, shortURL, originalURL)
-	shortenedURL := model.ShortenedURL{
-		ShortURL:    shortURL,
-		OriginalURL: originalURL,
+func (s *Inmem) SaveURL(ctx context.Context, userID string, url model.ShortenedURL) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	log.Printf("Saving URL for user %s: shortURL='%s', originalURL='%s'", userID, url.ShortURL, url.OriginalURL)
+	if existing, ok := s.liveCode(url.OriginalURL, time.Now()); ok {
+		return &storage.ConflictError{ShortURL: existing}
 	}
-	if _, ok := storage.urlList[userID]; !ok {
-		storage.urlList[userID] = []model.ShortenedURL{}
+	if _, ok := s.owners[url.ShortURL]; ok {
+		return &storage.TakenError{ShortURL: url.ShortURL}
 	}
-	storage.urlList[userID] = append(storage.urlList[userID], shortenedURL)
+	s.save(userID, url)
 	return nil
 }
 
-func (storage *Inmem) GetURLsByUser(userID string) ([]model.ShortenedURL, error) {
-	storage.lock.Lock()
-	defer storage.lock.Unlock()
-	urls, ok := storage.urlList[userID]
+// liveCode returns the code stored for originalURL unless that link has
+// expired; expired links no longer hold their original URL. The caller
+// holds s.lock.
+func (s *Inmem) liveCode(originalURL string, now time.Time) (string, bool) {
+	code, ok := s.originals[originalURL]
 	if !ok {
-		return nil, nil
+		return "", false
+	}
+	for _, u := range s.urlList[s.owners[code]] {
+		if u.ShortURL == code {
+			return code, !u.Expired(now)
+		}
+	}
+	return "", false
+}
+
+func (s *Inmem) save(userID string, url model.ShortenedURL) {
+	if _, ok := s.urlList[userID]; !ok {
+		s.urlList[userID] = []model.ShortenedURL{}
+	}
+	s.urlList[userID] = append(s.urlList[userID], url)
+	s.owners[url.ShortURL] = userID
+	if !url.IsDeleted {
+		s.originals[url.OriginalURL] = url.ShortURL
 	}
-	return urls, nil
 }
 
-func (storage *Inmem) Ping(ctx context.Context) error {
+func (s *Inmem) SaveBatch(ctx context.Context, urls []model.DbSave) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	codes := make(map[string]struct{}, len(urls))
+	for _, u := range urls {
+		if _, ok := s.liveCode(u.Original_url, now); ok {
+			continue
+		}
+		if _, ok := s.owners[u.Short_url]; ok {
+			return &storage.TakenError{ShortURL: u.Short_url}
+		}
+		if _, ok := codes[u.Short_url]; ok {
+			return &storage.TakenError{ShortURL: u.Short_url}
+		}
+		codes[u.Short_url] = struct{}{}
+	}
+	conflict := false
+	for i, u := range urls {
+		if existing, ok := s.liveCode(u.Original_url, now); ok {
+			urls[i].Short_url = existing
+			conflict = true
+			continue
+		}
+		s.save(u.UserID, model.ShortenedURL{
+			ShortURL:    u.Short_url,
+			OriginalURL: u.Original_url,
+			ExpiresAt:   u.ExpiresAt,
+		})
+	}
+	if conflict {
+		return storage.ErrURLExists
+	}
 	return nil
 }
 
-func (storage *Inmem) FindUsersOrigURL(userID, shortURL string) (string, error) {
-	pairsURL, ok := storage.urlList[userID]
-	if !ok {
-		log.Printf("Can`t find this Users URL`s")
-		return "", fmt.Errorf("User Not Found")
+func (s *Inmem) DeleteURLs(ctx context.Context, userID string, shortURLs []string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	toDelete := make(map[string]struct{}, len(shortURLs))
+	for _, shortURL := range shortURLs {
+		toDelete[shortURL] = struct{}{}
+	}
+	urls := s.urlList[userID]
+	for i := range urls {
+		if _, ok := toDelete[urls[i].ShortURL]; ok {
+			urls[i].IsDeleted = true
+			if s.originals[urls[i].OriginalURL] == urls[i].ShortURL {
+				delete(s.originals, urls[i].OriginalURL)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Inmem) GetURLsByUser(ctx context.Context, userID string) ([]model.ShortenedURL, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	var urls []model.ShortenedURL
+	for _, u := range s.urlList[userID] {
+		if !u.IsDeleted && !u.Expired(now) {
+			urls = append(urls, u)
+		}
 	}
-	for _, v := range pairsURL {
+	return urls, nil
+}
+
+func (s *Inmem) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (s *Inmem) Close() error {
+	return nil
+}
+
+func (s *Inmem) FindUsersOrigURL(ctx context.Context, userID, shortURL string) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, v := range s.urlList[userID] {
 		if v.ShortURL == shortURL {
 			return v.OriginalURL, nil
 		}
 	}
-	return "", fmt.Errorf("Can`t find %s for current user", shortURL)
+	return "", fmt.Errorf("short URL %s for user %s: %w", shortURL, userID, storage.ErrNotFound)
+}
+
+func (s *Inmem) FindOrigURL(ctx context.Context, shortURL string) (string, error) {
+	url, err := s.FindLink(ctx, shortURL)
+	return url.OriginalURL, err
+}
+
+func (s *Inmem) FindLink(ctx context.Context, shortURL string) (model.ShortenedURL, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	userID, ok := s.owners[shortURL]
+	if !ok {
+		return model.ShortenedURL{}, storage.ErrNotFound
+	}
+	for _, v := range s.urlList[userID] {
+		if v.ShortURL != shortURL {
+			continue
+		}
+		if v.IsDeleted {
+			return model.ShortenedURL{}, storage.ErrDeleted
+		}
+		if v.Expired(time.Now()) {
+			return model.ShortenedURL{}, storage.ErrExpired
+		}
+		return v, nil
+	}
+	return model.ShortenedURL{}, storage.ErrNotFound
+}
+
+// PurgeExpired drops expired links together with their indexes and clicks,
+// which frees both the short code and the original URL for reuse.
+func (s *Inmem) PurgeExpired(ctx context.Context) (int64, error) {
+	return s.Drop(s.ExpiredCodes(time.Now())), nil
+}
+
+// ExpiredCodes lists the short codes of links that have expired by now.
+func (s *Inmem) ExpiredCodes(now time.Time) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var codes []string
+	for _, urls := range s.urlList {
+		for _, u := range urls {
+			if u.Expired(now) {
+				codes = append(codes, u.ShortURL)
+			}
+		}
+	}
+	return codes
+}
+
+// Drop removes the links stored under shortURLs, whoever owns them, along
+// with their indexes and clicks, and reports how many it found.
+func (s *Inmem) Drop(shortURLs []string) int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var dropped int64
+	for _, code := range shortURLs {
+		userID, ok := s.owners[code]
+		if !ok {
+			continue
+		}
+		urls := s.urlList[userID]
+		for i, u := range urls {
+			if u.ShortURL != code {
+				continue
+			}
+			s.urlList[userID] = append(urls[:i], urls[i+1:]...)
+			if s.originals[u.OriginalURL] == code {
+				delete(s.originals, u.OriginalURL)
+			}
+			break
+		}
+		delete(s.owners, code)
+		delete(s.clicks, code)
+		dropped++
+	}
+	return dropped
+}
+
+func (s *Inmem) SaveClicks(ctx context.Context, clicks []model.Click) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, c := range clicks {
+		s.clicks[c.ShortURL] = append(s.clicks[c.ShortURL], c)
+	}
+	return nil
+}
+
+func (s *Inmem) GetLinkStats(ctx context.Context, userID, shortURL string, bucket time.Duration) (model.LinkStats, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if owner, ok := s.owners[shortURL]; !ok || owner != userID {
+		return model.LinkStats{}, storage.ErrNotFound
+	}
+	stats := model.LinkStats{ShortURL: shortURL, Histogram: []model.StatsBucket{}}
+	visitors := make(map[string]struct{})
+	buckets := make(map[time.Time]int64)
+	for _, c := range s.clicks[shortURL] {
+		stats.TotalClicks++
+		visitors[c.ClientIP+"|"+c.UserAgent] = struct{}{}
+		buckets[c.Timestamp.UTC().Truncate(bucket)]++
+	}
+	stats.UniqueVisitors = int64(len(visitors))
+	for start, clicks := range buckets {
+		stats.Histogram = append(stats.Histogram, model.StatsBucket{Start: start, Clicks: clicks})
+	}
+	sort.Slice(stats.Histogram, func(i, j int) bool {
+		return stats.Histogram[i].Start.Before(stats.Histogram[j].Start)
+	})
+	return stats, nil
+}
+
+// Restore puts url back as is, bypassing conflict checks. It lets backends
+// that keep their own persistence rebuild the in-memory state on startup,
+// in any order: a live link keeps its original URL when a deleted or
+// expired copy of it is restored afterwards.
+func (s *Inmem) Restore(userID string, url model.ShortenedURL) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	code, live := s.liveCode(url.OriginalURL, time.Now())
+	s.save(userID, url)
+	if live {
+		s.originals[url.OriginalURL] = code
+	}
+}
+
+// Forget removes the URL saved under shortURL by userID, so that backends
+// can undo a save they failed to persist.
+func (s *Inmem) Forget(userID, shortURL string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	urls := s.urlList[userID]
+	for i, u := range urls {
+		if u.ShortURL != shortURL {
+			continue
+		}
+		s.urlList[userID] = append(urls[:i], urls[i+1:]...)
+		delete(s.owners, shortURL)
+		if s.originals[u.OriginalURL] == shortURL {
+			delete(s.originals, u.OriginalURL)
+		}
+		return
+	}
+}
+
+// Each calls fn for every stored URL, soft-deleted ones included, and for
+// every recorded click. The storage is locked while fn runs.
+func (s *Inmem) Each(fn func(userID string, url model.ShortenedURL), clickFn func(click model.Click)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for userID, urls := range s.urlList {
+		for _, u := range urls {
+			fn(userID, u)
+		}
+	}
+	for _, clicks := range s.clicks {
+		for _, c := range clicks {
+			clickFn(c)
+		}
+	}
 }
@@ -96,3 +96,94 @@
 // }
 
 package inmem
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Polad20/urlshortener/internal/model"
+	"github.com/Polad20/urlshortener/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPurgeExpired(t *testing.T) {
+	ctx := context.Background()
+	s := NewInmem()
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Hour)
+	require.NoError(t, s.SaveURL(ctx, "user1", model.ShortenedURL{ShortURL: "old", OriginalURL: "https://example.com/old", ExpiresAt: &past}))
+	require.NoError(t, s.SaveURL(ctx, "user1", model.ShortenedURL{ShortURL: "new", OriginalURL: "https://example.com/new", ExpiresAt: &future}))
+	require.NoError(t, s.SaveURL(ctx, "user1", model.ShortenedURL{ShortURL: "forever", OriginalURL: "https://example.com/forever"}))
+	require.NoError(t, s.SaveClicks(ctx, []model.Click{{ShortURL: "old", Timestamp: past}}))
+
+	_, err := s.FindOrigURL(ctx, "old")
+	assert.ErrorIs(t, err, storage.ErrExpired)
+
+	purged, err := s.PurgeExpired(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), purged)
+
+	_, err = s.FindOrigURL(ctx, "old")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	assert.NotContains(t, s.clicks, "old", "clicks of purged links should be dropped")
+	urls, err := s.GetURLsByUser(ctx, "user1")
+	require.NoError(t, err)
+	assert.Len(t, urls, 2)
+
+	err = s.SaveURL(ctx, "user2", model.ShortenedURL{ShortURL: "again", OriginalURL: "https://example.com/old"})
+	assert.NoError(t, err, "purged original URL should be free to shorten again")
+}
+
+func TestShortenAgainAfterDelete(t *testing.T) {
+	ctx := context.Background()
+	s := NewInmem()
+	require.NoError(t, s.SaveURL(ctx, "user1", model.ShortenedURL{ShortURL: "first", OriginalURL: "https://example.com/page"}))
+	require.NoError(t, s.DeleteURLs(ctx, "user1", []string{"first"}))
+
+	require.NoError(t, s.SaveURL(ctx, "user1", model.ShortenedURL{ShortURL: "second", OriginalURL: "https://example.com/page"}))
+	_, err := s.FindOrigURL(ctx, "first")
+	assert.ErrorIs(t, err, storage.ErrDeleted)
+	orig, err := s.FindOrigURL(ctx, "second")
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/page", orig)
+
+	var conflict *storage.ConflictError
+	require.ErrorAs(t, s.SaveURL(ctx, "user2", model.ShortenedURL{ShortURL: "third", OriginalURL: "https://example.com/page"}), &conflict)
+	assert.Equal(t, "second", conflict.ShortURL)
+
+	// Restoring the deleted link after the live one must not take the URL back.
+	restored := NewInmem()
+	restored.Restore("user1", model.ShortenedURL{ShortURL: "second", OriginalURL: "https://example.com/page"})
+	restored.Restore("user1", model.ShortenedURL{ShortURL: "first", OriginalURL: "https://example.com/page", IsDeleted: true})
+	require.ErrorAs(t, restored.SaveURL(ctx, "user2", model.ShortenedURL{ShortURL: "third", OriginalURL: "https://example.com/page"}), &conflict)
+	assert.Equal(t, "second", conflict.ShortURL)
+}
+
+func TestShortenAgainAfterExpiry(t *testing.T) {
+	ctx := context.Background()
+	s := NewInmem()
+	past := time.Now().Add(-time.Minute)
+	require.NoError(t, s.SaveURL(ctx, "user1", model.ShortenedURL{ShortURL: "old", OriginalURL: "https://example.com/page", ExpiresAt: &past}))
+	urls, err := s.GetURLsByUser(ctx, "user1")
+	require.NoError(t, err)
+	assert.Empty(t, urls, "expired links are not listed")
+
+	require.NoError(t, s.SaveURL(ctx, "user2", model.ShortenedURL{ShortURL: "new", OriginalURL: "https://example.com/page"}),
+		"an expired link does not hold its original URL")
+	batch := []model.DbSave{{UserID: "user3", Short_url: "other", Original_url: "https://example.com/page"}}
+	assert.ErrorIs(t, s.SaveBatch(ctx, batch), storage.ErrURLExists)
+	assert.Equal(t, "new", batch[0].Short_url)
+	_, err = s.FindOrigURL(ctx, "old")
+	assert.ErrorIs(t, err, storage.ErrExpired)
+
+	_, err = s.PurgeExpired(ctx)
+	require.NoError(t, err)
+	orig, err := s.FindOrigURL(ctx, "new")
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/page", orig)
+	var conflict *storage.ConflictError
+	require.ErrorAs(t, s.SaveURL(ctx, "user3", model.ShortenedURL{ShortURL: "third", OriginalURL: "https://example.com/page"}), &conflict)
+	assert.Equal(t, "new", conflict.ShortURL)
+}
@@ -0,0 +1,96 @@
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Polad20/urlshortener/internal/auth"
+	"github.com/Polad20/urlshortener/internal/storage"
+	"github.com/lib/pq"
+)
+
+// PostgresStorage is also an auth.KeyStore, keeping keys in api_keys.
+var _ auth.KeyStore = (*PostgresStorage)(nil)
+
+const keyColumns = "id, user_id, name, hash, scopes, created_at, last_used_at, revoked_at"
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanKey(row rowScanner) (auth.APIKey, error) {
+	var key auth.APIKey
+	var lastUsed, revoked sql.NullTime
+	err := row.Scan(&key.ID, &key.UserID, &key.Name, &key.Hash, pq.Array(&key.Scopes), &key.CreatedAt, &lastUsed, &revoked)
+	if lastUsed.Valid {
+		key.LastUsedAt = &lastUsed.Time
+	}
+	if revoked.Valid {
+		key.RevokedAt = &revoked.Time
+	}
+	return key, err
+}
+
+func (p *PostgresStorage) CreateKey(ctx context.Context, key auth.APIKey) error {
+	_, err := p.DB.ExecContext(ctx, "INSERT INTO api_keys("+keyColumns+") VALUES($1,$2,$3,$4,$5,$6,$7,$8)",
+		key.ID, key.UserID, key.Name, key.Hash, pq.Array(key.Scopes), key.CreatedAt, key.LastUsedAt, key.RevokedAt)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == uniqueViolation {
+		return fmt.Errorf("API key %s: %w", key.ID, storage.ErrConflict)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create API key: %w", storage.Classify(err))
+	}
+	return nil
+}
+
+func (p *PostgresStorage) FindKey(ctx context.Context, id string) (auth.APIKey, error) {
+	key, err := scanKey(p.DB.QueryRowContext(ctx, "SELECT "+keyColumns+" FROM api_keys WHERE id = $1", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return auth.APIKey{}, auth.ErrKeyNotFound
+	}
+	if err != nil {
+		return auth.APIKey{}, fmt.Errorf("failed to find API key %s: %w", id, storage.Classify(err))
+	}
+	return key, nil
+}
+
+func (p *PostgresStorage) ListKeys(ctx context.Context, userID string) ([]auth.APIKey, error) {
+	rows, err := p.DB.QueryContext(ctx, "SELECT "+keyColumns+" FROM api_keys WHERE user_id = $1 ORDER BY created_at", userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list API keys: %w", storage.Classify(err))
+	}
+	defer rows.Close()
+	var keys []auth.APIKey
+	for rows.Next() {
+		key, err := scanKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan API key: %w", storage.Classify(err))
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (p *PostgresStorage) RevokeKey(ctx context.Context, userID, id string, at time.Time) error {
+	res, err := p.DB.ExecContext(ctx,
+		"UPDATE api_keys SET revoked_at = COALESCE(revoked_at, $3) WHERE id = $1 AND user_id = $2", id, userID, at)
+	if err != nil {
+		return fmt.Errorf("failed to revoke API key %s: %w", id, storage.Classify(err))
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return auth.ErrKeyNotFound
+	}
+	return nil
+}
+
+func (p *PostgresStorage) TouchKey(ctx context.Context, id string, at time.Time) error {
+	_, err := p.DB.ExecContext(ctx, "UPDATE api_keys SET last_used_at = $2 WHERE id = $1", id, at)
+	if err != nil {
+		return fmt.Errorf("failed to update last use of API key %s: %w", id, storage.Classify(err))
+	}
+	return nil
+}
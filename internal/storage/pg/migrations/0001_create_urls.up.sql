@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS urls (
+    short_url      TEXT PRIMARY KEY,
+    user_id        TEXT NOT NULL,
+    correlation_id TEXT NOT NULL DEFAULT '',
+    original_url   TEXT NOT NULL,
+    is_deleted     BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at     TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS urls_original_url_key ON urls (original_url);
+CREATE INDEX IF NOT EXISTS urls_user_id_idx ON urls (user_id);
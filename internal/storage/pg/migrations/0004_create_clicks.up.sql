@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS clicks (
+    id         BIGSERIAL PRIMARY KEY,
+    short_url  TEXT NOT NULL,
+    clicked_at TIMESTAMPTZ NOT NULL,
+    referrer   TEXT NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT '',
+    client_ip  TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS clicks_short_url_clicked_at_idx ON clicks (short_url, clicked_at);
@@ -0,0 +1,3 @@
+-- The domain the codes were stored with is not known here, so the bare codes
+-- are kept as is.
+SELECT 1;
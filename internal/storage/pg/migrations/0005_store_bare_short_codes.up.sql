@@ -0,0 +1,3 @@
+-- Short URLs used to be stored with the service domain in front of the code.
+UPDATE urls SET short_url = regexp_replace(short_url, '^.*/', '') WHERE short_url LIKE '%/%';
+UPDATE clicks SET short_url = regexp_replace(short_url, '^.*/', '') WHERE short_url LIKE '%/%';
@@ -0,0 +1,7 @@
+-- Keep one row per original URL, preferring the live one, so that the
+-- unconditional index can be built again.
+DELETE FROM urls u USING urls o
+WHERE u.original_url = o.original_url AND u.short_url <> o.short_url AND u.is_deleted
+  AND (NOT o.is_deleted OR o.short_url > u.short_url);
+DROP INDEX IF EXISTS urls_original_url_live_key;
+CREATE UNIQUE INDEX IF NOT EXISTS urls_original_url_key ON urls (original_url);
@@ -0,0 +1,3 @@
+-- Deleted links must not keep their original URL from being shortened again.
+DROP INDEX IF EXISTS urls_original_url_key;
+CREATE UNIQUE INDEX IF NOT EXISTS urls_original_url_live_key ON urls (original_url) WHERE NOT is_deleted;
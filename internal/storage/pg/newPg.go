@@ -6,21 +6,37 @@ import (
 	"errors"
 	"fmt"
 	"log"
-	"os"
 	"strings"
+	"time"
 
 	"github.com/Polad20/urlshortener/internal/model"
-	"github.com/Polad20/urlshortener/internal/shortener"
+	"github.com/Polad20/urlshortener/internal/storage"
+	"github.com/lib/pq"
 )
 
-var ErrURLNotFoundForUser = errors.New("URL not found for user")
+// ErrURLNotFoundForUser matches storage.ErrNotFound.
+var ErrURLNotFoundForUser = fmt.Errorf("URL not found for user: %w", storage.ErrNotFound)
+
+const (
+	uniqueViolation = "23505"
+	shortURLKey     = "urls_pkey"
+)
+
+// mapInsertError turns a primary key violation on the short URL into
+// a *storage.TakenError so that callers can retry with a fresh code.
+func mapInsertError(err error, shortURL string) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == uniqueViolation && pqErr.Constraint == shortURLKey {
+		return &storage.TakenError{ShortURL: shortURL}
+	}
+	return storage.Classify(err)
+}
 
 type PostgresStorage struct {
 	DB *sql.DB
 }
 
-func NewPostgresStorage() (*PostgresStorage, error) {
-	dsn := os.Getenv("PG_URL")
+func NewPostgresStorage(dsn string) (*PostgresStorage, error) {
 	db, err := sql.Open("postgres", dsn)
 	if err != nil {
 		log.Printf("Error opening DB, %v", err)
@@ -29,7 +45,13 @@ func NewPostgresStorage() (*PostgresStorage, error) {
 	err = db.Ping()
 	if err != nil {
 		db.Close()
-		log.Fatalf("Ошибка при проверке соединения с базой данных: %v", err)
+		return nil, fmt.Errorf("ошибка при проверке соединения с базой данных: %w", err)
+	}
+	err = MigrateUp(context.Background(), db)
+	if err != nil {
+		db.Close()
+		log.Printf("Error applying migrations, %v", err)
+		return nil, err
 	}
 	postgresStorage := PostgresStorage{
 		DB: db,
@@ -37,71 +59,221 @@ func NewPostgresStorage() (*PostgresStorage, error) {
 	return &postgresStorage, nil
 }
 
-func (p *PostgresStorage) BaseSave(ctx context.Context, dbToSave []model.DbSave) error {
+func (p *PostgresStorage) SaveBatch(ctx context.Context, dbToSave []model.DbSave) error {
 	tx, err := p.DB.BeginTx(ctx, nil)
 	if err != nil {
 		log.Printf("Error creating transaction: %v", err)
-		return err
+		return storage.Classify(err)
 	}
 	defer tx.Rollback()
-	stmt, err := tx.PrepareContext(ctx, "INSERT INTO public.test_table(UserID, Correlation_id, Original_url,Short_url) VALUES($1,$2,$3,$4) ON CONFLICT(Original_url) DO NOTHING")
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO urls(user_id, correlation_id, original_url, short_url, expires_at) VALUES($1,$2,$3,$4,$5) ON CONFLICT(original_url) WHERE NOT is_deleted DO NOTHING")
 	if err != nil {
 		log.Printf("Error creating statement: %v", err)
-		return err
+		return storage.Classify(err)
 	}
 	defer stmt.Close()
-	for _, v := range dbToSave {
-		if _, err = stmt.ExecContext(ctx, v.UserID, v.Correlation_id, v.Original_url, v.Short_url); err != nil {
+	conflict := false
+	for i, v := range dbToSave {
+		if err := retireExpired(ctx, tx, v.Original_url); err != nil {
+			return err
+		}
+		res, err := stmt.ExecContext(ctx, v.UserID, v.Correlation_id, v.Original_url, v.Short_url, v.ExpiresAt)
+		if err != nil {
 			log.Printf("Error execing statement: %v", err)
+			return mapInsertError(err, v.Short_url)
+		}
+		if inserted, err := res.RowsAffected(); err != nil || inserted > 0 {
+			continue
+		}
+		existing, err := existingShortURL(ctx, tx, v.Original_url)
+		if err != nil {
 			return err
 		}
+		dbToSave[i].Short_url = existing
+		conflict = true
+	}
+	if err := tx.Commit(); err != nil {
+		return storage.Classify(err)
 	}
-	return tx.Commit()
+	if conflict {
+		return storage.ErrURLExists
+	}
+	return nil
+}
 
+// retireExpired takes the original URL away from its expired link, which
+// the unique index on live rows cannot tell apart by itself because its
+// predicate may not depend on now(). The link keeps answering as expired
+// until PurgeExpired drops it.
+func retireExpired(ctx context.Context, tx *sql.Tx, originalURL string) error {
+	_, err := tx.ExecContext(ctx, "UPDATE urls SET is_deleted = TRUE WHERE original_url = $1 AND NOT is_deleted AND expires_at <= now()", originalURL)
+	if err != nil {
+		return fmt.Errorf("failed to retire expired links of %s: %w", originalURL, storage.Classify(err))
+	}
+	return nil
 }
 
-func DbSavePrepare(userID string, item model.Incoming, shortener *shortener.Shortener) (model.DbSave, error) {
-	var newDbItem model.DbSave
-	newDbItem.UserID = userID
-	newDbItem.Correlation_id = item.Correlation_id
-	newDbItem.Original_url = item.Original_url
-	newDbItem.Short_url = shortener.Shorten()
-	return newDbItem, nil
+func existingShortURL(ctx context.Context, tx *sql.Tx, originalURL string) (string, error) {
+	var shortURL string
+	err := tx.QueryRowContext(ctx, "SELECT short_url FROM urls WHERE original_url = $1 AND NOT is_deleted", originalURL).Scan(&shortURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to find existing short URL for %s: %w", originalURL, storage.Classify(err))
+	}
+	return shortURL, nil
+}
+
+func (p *PostgresStorage) NextID(ctx context.Context) (uint64, error) {
+	var id uint64
+	err := p.DB.QueryRowContext(ctx, "SELECT nextval('short_url_seq')").Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get next short URL id: %w", storage.Classify(err))
+	}
+	return id, nil
 }
 
 func (p *PostgresStorage) Ping(ctx context.Context) error {
-	return p.DB.PingContext(ctx)
+	return storage.Classify(p.DB.PingContext(ctx))
 }
 
-func (p *PostgresStorage) GetURLsByUser(userID string) ([]model.ShortenedURL, error) {
-	return nil, nil
+func (p *PostgresStorage) Close() error {
+	return p.DB.Close()
 }
 
-func (p *PostgresStorage) SaveURL(userID, shortURL, originalURL string) error {
-	return nil
+func (p *PostgresStorage) GetURLsByUser(ctx context.Context, userID string) ([]model.ShortenedURL, error) {
+	if userID == "" {
+		return nil, errors.New("Got empty userID")
+	}
+	query := "SELECT short_url, original_url, expires_at FROM urls WHERE user_id = $1 AND NOT is_deleted AND (expires_at IS NULL OR expires_at > now())"
+	rows, err := p.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query URLs for user %s: %w", userID, storage.Classify(err))
+	}
+	defer rows.Close()
+	var urls []model.ShortenedURL
+	for rows.Next() {
+		var u model.ShortenedURL
+		if err := rows.Scan(&u.ShortURL, &u.OriginalURL, &u.ExpiresAt); err != nil {
+			return nil, fmt.Errorf("failed to scan URL row for user %s: %w", userID, storage.Classify(err))
+		}
+		urls = append(urls, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate URLs for user %s: %w", userID, storage.Classify(err))
+	}
+	return urls, nil
+}
+
+func (p *PostgresStorage) SaveURL(ctx context.Context, userID string, url model.ShortenedURL) error {
+	if userID == "" || url.ShortURL == "" || url.OriginalURL == "" {
+		return errors.New("Got empty userID, shortURL or originalURL")
+	}
+	tx, err := p.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin save transaction: %w", storage.Classify(err))
+	}
+	defer tx.Rollback()
+	if err := retireExpired(ctx, tx, url.OriginalURL); err != nil {
+		return err
+	}
+	query := "INSERT INTO urls(user_id, correlation_id, original_url, short_url, expires_at) VALUES($1, $2, $3, $4, $5) ON CONFLICT(original_url) WHERE NOT is_deleted DO NOTHING"
+	res, err := tx.ExecContext(ctx, query, userID, "", url.OriginalURL, url.ShortURL, url.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to save short URL %s for user %s: %w", url.ShortURL, userID, mapInsertError(err, url.ShortURL))
+	}
+	if inserted, err := res.RowsAffected(); err == nil && inserted == 0 {
+		existing, err := existingShortURL(ctx, tx, url.OriginalURL)
+		if err != nil {
+			return err
+		}
+		return &storage.ConflictError{ShortURL: existing}
+	}
+	return storage.Classify(tx.Commit())
 }
 
-func (p *PostgresStorage) FindUsersOrigURL(userID, shortURL string) (string, error) {
+func (p *PostgresStorage) FindUsersOrigURL(ctx context.Context, userID, shortURL string) (string, error) {
 	if userID == "" || shortURL == "" {
 		return "", errors.New("Got empty userID or shortURL")
 	}
-	query := "SELECT Original_url FROM public.test_table WHERE UserID = $1 AND Short_url = $2"
+	query := "SELECT original_url FROM urls WHERE user_id = $1 AND short_url = $2"
 	var originalURL string
-	row := p.DB.QueryRow(query, userID, shortURL)
+	row := p.DB.QueryRowContext(ctx, query, userID, shortURL)
 	err := row.Scan(&originalURL)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return "", fmt.Errorf("short URL %s not found for user %s: %w", shortURL, userID, ErrURLNotFoundForUser)
 		}
-		return "", fmt.Errorf("failed to scan result for short URL %s for user %s: %w", shortURL, userID, err)
+		return "", fmt.Errorf("failed to scan result for short URL %s for user %s: %w", shortURL, userID, storage.Classify(err))
 	}
 	return originalURL, nil
 }
 
-func (p *PostgresStorage) DeleteURLs(userID string, batchIDs []string, tx *sql.Tx) error {
-	if len(batchIDs) == 0 {
+func (p *PostgresStorage) FindOrigURL(ctx context.Context, shortURL string) (string, error) {
+	url, err := p.FindLink(ctx, shortURL)
+	return url.OriginalURL, err
+}
+
+func (p *PostgresStorage) FindLink(ctx context.Context, shortURL string) (model.ShortenedURL, error) {
+	if shortURL == "" {
+		return model.ShortenedURL{}, errors.New("Got empty shortURL")
+	}
+	query := "SELECT original_url, is_deleted, expires_at, expires_at <= now() FROM urls WHERE short_url = $1"
+	url := model.ShortenedURL{ShortURL: shortURL}
+	var isDeleted bool
+	var isExpired sql.NullBool
+	err := p.DB.QueryRowContext(ctx, query, shortURL).Scan(&url.OriginalURL, &isDeleted, &url.ExpiresAt, &isExpired)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return model.ShortenedURL{}, fmt.Errorf("short URL %s: %w", shortURL, storage.ErrNotFound)
+		}
+		return model.ShortenedURL{}, fmt.Errorf("failed to scan result for short URL %s: %w", shortURL, storage.Classify(err))
+	}
+	// Expiry goes first: retireExpired marks expired links deleted.
+	if isExpired.Bool {
+		return model.ShortenedURL{}, fmt.Errorf("short URL %s: %w", shortURL, storage.ErrExpired)
+	}
+	if isDeleted {
+		return model.ShortenedURL{}, fmt.Errorf("short URL %s: %w", shortURL, storage.ErrDeleted)
+	}
+	return url, nil
+}
+
+// PurgeExpired drops expired links together with their clicks, which frees
+// both the short code and the original URL for reuse.
+func (p *PostgresStorage) PurgeExpired(ctx context.Context) (int64, error) {
+	var purged int64
+	err := p.DB.QueryRowContext(ctx, `WITH purged AS (
+		DELETE FROM urls WHERE expires_at <= now() RETURNING short_url
+	), purged_clicks AS (
+		DELETE FROM clicks WHERE short_url IN (SELECT short_url FROM purged)
+	)
+	SELECT count(*) FROM purged`).Scan(&purged)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge expired URLs: %w", storage.Classify(err))
+	}
+	return purged, nil
+}
+
+const deleteBatchSize = 500
+
+func (p *PostgresStorage) DeleteURLs(ctx context.Context, userID string, shortURLs []string) error {
+	if len(shortURLs) == 0 {
 		return nil
 	}
+	tx, err := p.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin delete transaction: %w", storage.Classify(err))
+	}
+	defer tx.Rollback()
+	for start := 0; start < len(shortURLs); start += deleteBatchSize {
+		end := min(start+deleteBatchSize, len(shortURLs))
+		if err := deleteURLsChunk(ctx, tx, userID, shortURLs[start:end]); err != nil {
+			return err
+		}
+	}
+	return storage.Classify(tx.Commit())
+}
+
+func deleteURLsChunk(ctx context.Context, tx *sql.Tx, userID string, batchIDs []string) error {
 	placeholders := make([]string, len(batchIDs))
 	args := make([]any, len(batchIDs)+1)
 	args[0] = userID
@@ -109,12 +281,66 @@ func (p *PostgresStorage) DeleteURLs(userID string, batchIDs []string, tx *sql.T
 		placeholders[i] = fmt.Sprintf("$%d", i+2)
 		args[i+1] = batchIDs[i]
 	}
-	query := `UPDATE urls SET is_deleted = TRUE WHERE user_id = $1 AND id IN (` +
+	query := `UPDATE urls SET is_deleted = TRUE WHERE user_id = $1 AND short_url IN (` +
 		strings.Join(placeholders, ", ") + `);`
 
-	_, err := tx.Exec(query, args...)
+	_, err := tx.ExecContext(ctx, query, args...)
 	if err != nil {
-		return fmt.Errorf("Failed to execute batch update")
+		return fmt.Errorf("Failed to execute batch update: %w", storage.Classify(err))
 	}
 	return nil
 }
+
+func (p *PostgresStorage) SaveClicks(ctx context.Context, clicks []model.Click) error {
+	if len(clicks) == 0 {
+		return nil
+	}
+	tx, err := p.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin clicks transaction: %w", storage.Classify(err))
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO clicks(short_url, clicked_at, referrer, user_agent, client_ip) VALUES($1, $2, $3, $4, $5)")
+	if err != nil {
+		return fmt.Errorf("failed to prepare clicks statement: %w", storage.Classify(err))
+	}
+	defer stmt.Close()
+	for _, c := range clicks {
+		if _, err := stmt.ExecContext(ctx, c.ShortURL, c.Timestamp, c.Referrer, c.UserAgent, c.ClientIP); err != nil {
+			return fmt.Errorf("failed to save click for %s: %w", c.ShortURL, storage.Classify(err))
+		}
+	}
+	return storage.Classify(tx.Commit())
+}
+
+func (p *PostgresStorage) GetLinkStats(ctx context.Context, userID, shortURL string, bucket time.Duration) (model.LinkStats, error) {
+	stats := model.LinkStats{ShortURL: shortURL, Histogram: []model.StatsBucket{}}
+	var owned bool
+	err := p.DB.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM urls WHERE short_url = $1 AND user_id = $2)", shortURL, userID).Scan(&owned)
+	if err != nil {
+		return stats, fmt.Errorf("failed to check owner of %s: %w", shortURL, storage.Classify(err))
+	}
+	if !owned {
+		return stats, fmt.Errorf("short URL %s for user %s: %w", shortURL, userID, storage.ErrNotFound)
+	}
+	err = p.DB.QueryRowContext(ctx,
+		"SELECT count(*), count(DISTINCT (client_ip, user_agent)) FROM clicks WHERE short_url = $1", shortURL,
+	).Scan(&stats.TotalClicks, &stats.UniqueVisitors)
+	if err != nil {
+		return stats, fmt.Errorf("failed to count clicks for %s: %w", shortURL, storage.Classify(err))
+	}
+	rows, err := p.DB.QueryContext(ctx, `SELECT to_timestamp(floor(extract(epoch FROM clicked_at) / $2) * $2) AS bucket, count(*)
+		FROM clicks WHERE short_url = $1 GROUP BY bucket ORDER BY bucket`, shortURL, bucket.Seconds())
+	if err != nil {
+		return stats, fmt.Errorf("failed to build click histogram for %s: %w", shortURL, storage.Classify(err))
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var b model.StatsBucket
+		if err := rows.Scan(&b.Start, &b.Clicks); err != nil {
+			return stats, fmt.Errorf("failed to scan click histogram for %s: %w", shortURL, storage.Classify(err))
+		}
+		stats.Histogram = append(stats.Histogram, b)
+	}
+	return stats, rows.Err()
+}
@@ -7,7 +7,10 @@ import (
 	"fmt"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/Polad20/urlshortener/internal/model"
+	"github.com/Polad20/urlshortener/internal/storage"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -29,15 +32,18 @@ func openTestDBConnection(t *testing.T) *sql.DB {
 	require.NoError(t, err, "не удалось подключиться к тестовой БД")
 	err = db.Ping()
 	require.NoError(t, err, "Не удалось проверить соединение с тестовой БД")
+	err = MigrateUp(context.Background(), db)
+	require.NoError(t, err, "Не удалось применить миграции к тестовой БД")
 	return db
 }
 
 func cleanTables(t *testing.T, db *sql.DB) {
-	_, err := db.Exec("DELETE FROM public.test_table; DELETE FROM urls;")
+	_, err := db.Exec("DELETE FROM urls;")
 	require.NoError(t, err, "Не удалось очистить тестовые таблицы")
 }
 
 func TestFindUsersOrigURL(t *testing.T) {
+	ctx := context.Background()
 	db := openTestDBConnection(t)
 	defer db.Close()
 
@@ -52,24 +58,24 @@ func TestFindUsersOrigURL(t *testing.T) {
 		{
 			name: "Succesfull find",
 			setupData: func(t *testing.T, tx *sql.Tx) {
-				_, err := tx.Exec(`INSERT INTO public.test_table (UserID, Correlation_id, Original_url, Short_url) VALUES ($1, $2, $3, $4)`,
-					"user1", "corr1", "https://example.com/original1", "http://localhost:8080/short1")
+				_, err := tx.Exec(`INSERT INTO urls (user_id, correlation_id, original_url, short_url) VALUES ($1, $2, $3, $4)`,
+					"user1", "corr1", "https://example.com/original1", "short1")
 				require.NoError(t, err, "Не удалось вставить тестовые данные для кейса 'Succesfull find'")
 			},
 			userID:              "user1",
-			shortURL:            "http://localhost:8080/short1",
+			shortURL:            "short1",
 			expectedOriginalURL: "https://example.com/original1",
 			expectedError:       nil,
 		},
 		{
 			name: "URL not found for user",
 			setupData: func(t *testing.T, tx *sql.Tx) {
-				_, err := tx.Exec(`INSERT INTO public.test_table (UserID, Correlation_id, Original_url, Short_url) VALUES ($1, $2, $3, $4)`,
-					"user2", "corr2a", "https://example.com/original2a", "http://localhost:8080/short2a")
+				_, err := tx.Exec(`INSERT INTO urls (user_id, correlation_id, original_url, short_url) VALUES ($1, $2, $3, $4)`,
+					"user2", "corr2a", "https://example.com/original2a", "short2a")
 				require.NoError(t, err, "Не удалось вставить тестовые данные для кейса 'URL not found for user'")
 			},
 			userID:              "user2",
-			shortURL:            "http://localhost:8080/short2b",
+			shortURL:            "short2b",
 			expectedOriginalURL: "",
 			expectedError:       ErrURLNotFoundForUser,
 		},
@@ -77,7 +83,7 @@ func TestFindUsersOrigURL(t *testing.T) {
 			name:                "User not found test",
 			setupData:           func(t *testing.T, tx *sql.Tx) {},
 			userID:              "nope",
-			shortURL:            "http://localhost:8080/nope",
+			shortURL:            "nope",
 			expectedOriginalURL: "",
 			expectedError:       ErrURLNotFoundForUser,
 		},
@@ -85,7 +91,7 @@ func TestFindUsersOrigURL(t *testing.T) {
 			name:                "No userID provided test",
 			setupData:           func(t *testing.T, tx *sql.Tx) {},
 			userID:              "",
-			shortURL:            "http://localhost:8080/any",
+			shortURL:            "any",
 			expectedOriginalURL: "",
 			expectedError:       errors.New("Got Empty userID"),
 		},
@@ -106,7 +112,7 @@ func TestFindUsersOrigURL(t *testing.T) {
 			cleanTables(t, db)
 			tc.setupData(t, tx)
 			pgOne := PostgresStorage{DB: db}
-			foundURL, err := pgOne.FindUsersOrigURL(tc.userID, tc.shortURL)
+			foundURL, err := pgOne.FindUsersOrigURL(ctx, tc.userID, tc.shortURL)
 			if tc.expectedError == nil {
 				assert.NoError(t, err, fmt.Sprintf("Ожидали nil, но получили %v", err))
 			} else {
@@ -125,3 +131,131 @@ func TestFindUsersOrigURL(t *testing.T) {
 		})
 	}
 }
+
+func TestSaveURLAndGetURLsByUser(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDBConnection(t)
+	defer db.Close()
+	cleanTables(t, db)
+	pgOne := PostgresStorage{DB: db}
+
+	err := pgOne.SaveURL(ctx, "user1", model.ShortenedURL{ShortURL: "short1", OriginalURL: "https://example.com/original1"})
+	require.NoError(t, err, "Не удалось сохранить первый URL")
+	err = pgOne.SaveURL(ctx, "user1", model.ShortenedURL{ShortURL: "short2", OriginalURL: "https://example.com/original2"})
+	require.NoError(t, err, "Не удалось сохранить второй URL")
+	err = pgOne.SaveURL(ctx, "user2", model.ShortenedURL{ShortURL: "short3", OriginalURL: "https://example.com/original3"})
+	require.NoError(t, err, "Не удалось сохранить URL другого пользователя")
+
+	urls, err := pgOne.GetURLsByUser(ctx, "user1")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []model.ShortenedURL{
+		{ShortURL: "short1", OriginalURL: "https://example.com/original1"},
+		{ShortURL: "short2", OriginalURL: "https://example.com/original2"},
+	}, urls)
+
+	urls, err = pgOne.GetURLsByUser(ctx, "nope")
+	require.NoError(t, err)
+	assert.Empty(t, urls, "У неизвестного пользователя не должно быть URL")
+
+	err = pgOne.SaveURL(ctx, "", model.ShortenedURL{ShortURL: "short4", OriginalURL: "https://example.com/original4"})
+	assert.Error(t, err, "Ожидали ошибку при пустом userID")
+}
+
+func TestShortenAgainAfterDelete(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDBConnection(t)
+	defer db.Close()
+	cleanTables(t, db)
+	pgOne := PostgresStorage{DB: db}
+
+	require.NoError(t, pgOne.SaveURL(ctx, "user1", model.ShortenedURL{ShortURL: "first", OriginalURL: "https://example.com/page"}))
+	require.NoError(t, pgOne.DeleteURLs(ctx, "user1", []string{"first"}))
+
+	err := pgOne.SaveURL(ctx, "user1", model.ShortenedURL{ShortURL: "second", OriginalURL: "https://example.com/page"})
+	require.NoError(t, err, "Удалённая ссылка не должна мешать сократить URL снова")
+	_, err = pgOne.FindOrigURL(ctx, "first")
+	assert.ErrorIs(t, err, storage.ErrDeleted)
+	orig, err := pgOne.FindOrigURL(ctx, "second")
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/page", orig)
+
+	var conflict *storage.ConflictError
+	require.ErrorAs(t, pgOne.SaveURL(ctx, "user2", model.ShortenedURL{ShortURL: "third", OriginalURL: "https://example.com/page"}), &conflict)
+	assert.Equal(t, "second", conflict.ShortURL)
+}
+
+func TestPurgeExpired(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDBConnection(t)
+	defer db.Close()
+	cleanTables(t, db)
+	pgOne := PostgresStorage{DB: db}
+
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+	require.NoError(t, pgOne.SaveURL(ctx, "user1", model.ShortenedURL{ShortURL: "old", OriginalURL: "https://example.com/old", ExpiresAt: &past}))
+	require.NoError(t, pgOne.SaveURL(ctx, "user1", model.ShortenedURL{ShortURL: "live", OriginalURL: "https://example.com/live", ExpiresAt: &future}))
+	require.NoError(t, pgOne.SaveClicks(ctx, []model.Click{{ShortURL: "old", Timestamp: past}}))
+
+	urls, err := pgOne.GetURLsByUser(ctx, "user1")
+	require.NoError(t, err)
+	require.Len(t, urls, 1, "Истёкшие ссылки не должны попадать в список пользователя")
+	assert.Equal(t, "live", urls[0].ShortURL)
+
+	purged, err := pgOne.PurgeExpired(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), purged)
+	_, err = pgOne.FindOrigURL(ctx, "old")
+	assert.ErrorIs(t, err, storage.ErrNotFound, "Истёкшая ссылка должна удаляться полностью")
+	var clicks int
+	require.NoError(t, db.QueryRowContext(ctx, "SELECT count(*) FROM clicks WHERE short_url = 'old'").Scan(&clicks))
+	assert.Zero(t, clicks)
+
+	require.NoError(t, pgOne.SaveURL(ctx, "user2", model.ShortenedURL{ShortURL: "new", OriginalURL: "https://example.com/old"}),
+		"После очистки оригинальный URL должен быть свободен")
+}
+
+func TestShortenAgainAfterExpiry(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDBConnection(t)
+	defer db.Close()
+	cleanTables(t, db)
+	pgOne := PostgresStorage{DB: db}
+
+	past := time.Now().Add(-time.Minute)
+	require.NoError(t, pgOne.SaveURL(ctx, "user1", model.ShortenedURL{ShortURL: "old", OriginalURL: "https://example.com/page", ExpiresAt: &past}))
+	require.NoError(t, pgOne.SaveURL(ctx, "user2", model.ShortenedURL{ShortURL: "new", OriginalURL: "https://example.com/page"}),
+		"Истёкшая ссылка не должна занимать оригинальный URL")
+	_, err := pgOne.FindOrigURL(ctx, "old")
+	assert.ErrorIs(t, err, storage.ErrExpired)
+	batch := []model.DbSave{{UserID: "user3", Short_url: "other", Original_url: "https://example.com/page"}}
+	assert.ErrorIs(t, pgOne.SaveBatch(ctx, batch), storage.ErrURLExists)
+	assert.Equal(t, "new", batch[0].Short_url)
+}
+
+func TestMigrations(t *testing.T) {
+	db := openTestDBConnection(t)
+	defer db.Close()
+	ctx := context.Background()
+
+	migrations, err := loadMigrations()
+	require.NoError(t, err, "Не удалось загрузить встроенные миграции")
+	require.NotEmpty(t, migrations)
+
+	statuses, err := MigrationsStatus(ctx, db)
+	require.NoError(t, err)
+	require.Len(t, statuses, len(migrations))
+	for _, s := range statuses {
+		assert.True(t, s.Applied, fmt.Sprintf("Миграция %d должна быть применена", s.Version))
+	}
+
+	require.NoError(t, MigrateDown(ctx, db), "Не удалось откатить последнюю миграцию")
+	statuses, err = MigrationsStatus(ctx, db)
+	require.NoError(t, err)
+	assert.False(t, statuses[len(statuses)-1].Applied, "Последняя миграция должна быть откачена")
+
+	require.NoError(t, MigrateUp(ctx, db), "Не удалось повторно применить миграции")
+	statuses, err = MigrationsStatus(ctx, db)
+	require.NoError(t, err)
+	assert.True(t, statuses[len(statuses)-1].Applied)
+}
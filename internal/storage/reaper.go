@@ -0,0 +1,33 @@
+package storage
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Reaper is implemented by backends that can clean up expired links.
+type Reaper interface {
+	PurgeExpired(ctx context.Context) (int64, error)
+}
+
+// RunReaper calls PurgeExpired every interval until ctx is cancelled.
+func RunReaper(ctx context.Context, r Reaper, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			purged, err := r.PurgeExpired(ctx)
+			if err != nil {
+				log.Printf("Error purging expired URLs: %v", err)
+				continue
+			}
+			if purged > 0 {
+				log.Printf("Purged %d expired URLs", purged)
+			}
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/Polad20/urlshortener/internal/model"
+	"github.com/Polad20/urlshortener/internal/storage"
+	goredis "github.com/redis/go-redis/v9"
+)
+
+func cacheKey(shortURL string) string { return keyPrefix + "cache:" + shortURL }
+
+// Cache serves redirects from Redis and falls back to the primary storage,
+// typically PostgreSQL, on a miss. Everything else goes straight to the
+// primary.
+type Cache struct {
+	storage.Storage
+	client *goredis.Client
+	ttl    time.Duration
+}
+
+func NewCache(primary storage.Storage, client *goredis.Client, ttl time.Duration) *Cache {
+	return &Cache{Storage: primary, client: client, ttl: ttl}
+}
+
+func (c *Cache) FindOrigURL(ctx context.Context, shortURL string) (string, error) {
+	url, err := c.FindLink(ctx, shortURL)
+	return url.OriginalURL, err
+}
+
+// FindLink only caches live links, for ttl or until they expire. Deleted,
+// expired and unknown codes are looked up in the primary every time.
+func (c *Cache) FindLink(ctx context.Context, shortURL string) (model.ShortenedURL, error) {
+	raw, err := c.client.Get(ctx, cacheKey(shortURL)).Bytes()
+	if err == nil {
+		var url model.ShortenedURL
+		// Entries that do not decode are left by older versions and are
+		// simply overwritten.
+		if json.Unmarshal(raw, &url) == nil {
+			return url, nil
+		}
+	} else if !errors.Is(err, goredis.Nil) {
+		// Redis being down only costs the cache, not the redirect.
+		return c.Storage.FindLink(ctx, shortURL)
+	}
+	url, err := c.Storage.FindLink(ctx, shortURL)
+	if err != nil {
+		return url, err
+	}
+	ttl := c.ttl
+	if url.ExpiresAt != nil {
+		ttl = min(ttl, time.Until(*url.ExpiresAt))
+	}
+	if raw, err := json.Marshal(url); err == nil && ttl > 0 {
+		c.client.Set(ctx, cacheKey(shortURL), raw, ttl)
+	}
+	return url, nil
+}
+
+func (c *Cache) DeleteURLs(ctx context.Context, userID string, shortURLs []string) error {
+	if err := c.Storage.DeleteURLs(ctx, userID, shortURLs); err != nil || len(shortURLs) == 0 {
+		return err
+	}
+	keys := make([]string, len(shortURLs))
+	for i, shortURL := range shortURLs {
+		keys[i] = cacheKey(shortURL)
+	}
+	// The links are deleted by now; a stale cache entry only lives out its
+	// ttl, so failing the request would misreport the delete.
+	if err := c.client.Del(ctx, keys...).Err(); err != nil {
+		log.Printf("Error invalidating %d cached links of user %s: %v", len(keys), userID, err)
+	}
+	return nil
+}
+
+func (c *Cache) PurgeExpired(ctx context.Context) (int64, error) {
+	reaper, ok := c.Storage.(storage.Reaper)
+	if !ok {
+		return 0, nil
+	}
+	return reaper.PurgeExpired(ctx)
+}
+
+func (c *Cache) Ping(ctx context.Context) error {
+	if err := c.client.Ping(ctx).Err(); err != nil {
+		return err
+	}
+	return c.Storage.Ping(ctx)
+}
+
+func (c *Cache) Close() error {
+	err := c.client.Close()
+	if primaryErr := c.Storage.Close(); primaryErr != nil {
+		return primaryErr
+	}
+	return err
+}
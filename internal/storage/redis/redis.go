@@ -0,0 +1,398 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Polad20/urlshortener/internal/model"
+	"github.com/Polad20/urlshortener/internal/storage"
+	goredis "github.com/redis/go-redis/v9"
+)
+
+// Key layout. Every link is a hash under url:<code> with the original URL,
+// owner, deleted flag and expiry; orig:<url> points back to the code,
+// clicks:<code> lists its clicks and user:<id> is the set of codes a user
+// created. Links with an expiry let Redis purge them: orig:<url> expires with
+// the link, so the URL can be shortened again, while url:<code> and
+// clicks:<code> stay for expiredGrace more, so the code answers 410 Gone
+// rather than 404 for a while.
+const (
+	keyPrefix = "urlshortener:"
+	seqKey    = keyPrefix + "seq"
+
+	expiredGrace = 24 * time.Hour
+)
+
+func urlKey(shortURL string) string     { return keyPrefix + "url:" + shortURL }
+func origKey(originalURL string) string { return keyPrefix + "orig:" + originalURL }
+func userKey(userID string) string      { return keyPrefix + "user:" + userID }
+func clicksKey(shortURL string) string  { return keyPrefix + "clicks:" + shortURL }
+
+// saveScript stores one link with its indexes unless the original URL is
+// already known (status 1, existing code) or the code is taken (status 2).
+var saveScript = goredis.NewScript(`
+local existing = redis.call('GET', KEYS[2])
+if existing then return {1, existing} end
+if redis.call('EXISTS', KEYS[1]) == 1 then return {2, ARGV[1]} end
+redis.call('HSET', KEYS[1], 'original', ARGV[2], 'user', ARGV[3], 'deleted', '0', 'expires_at', ARGV[4])
+redis.call('SET', KEYS[2], ARGV[1])
+redis.call('SADD', KEYS[3], ARGV[1])
+if ARGV[5] ~= '' then
+	redis.call('EXPIREAT', KEYS[1], ARGV[6])
+	redis.call('EXPIREAT', KEYS[2], ARGV[5])
+end
+return {0, ARGV[1]}
+`)
+
+// saveBatchScript is saveScript for a whole batch: KEYS and ARGV hold three
+// keys and six arguments per entry. Nothing is written when a code is
+// taken; otherwise it returns the code stored for every entry.
+var saveBatchScript = goredis.NewScript(`
+local n = #ARGV / 6
+local seen = {}
+for i = 0, n - 1 do
+	local code = ARGV[i*6+1]
+	if not redis.call('GET', KEYS[i*3+2]) then
+		if seen[code] or redis.call('EXISTS', KEYS[i*3+1]) == 1 then
+			return {'taken', code}
+		end
+		seen[code] = true
+	end
+end
+local result = {'ok'}
+for i = 0, n - 1 do
+	local existing = redis.call('GET', KEYS[i*3+2])
+	if existing then
+		table.insert(result, existing)
+	else
+		local a = i * 6
+		redis.call('HSET', KEYS[i*3+1], 'original', ARGV[a+2], 'user', ARGV[a+3], 'deleted', '0', 'expires_at', ARGV[a+4])
+		redis.call('SET', KEYS[i*3+2], ARGV[a+1])
+		redis.call('SADD', KEYS[i*3+3], ARGV[a+1])
+		if ARGV[a+5] ~= '' then
+			redis.call('EXPIREAT', KEYS[i*3+1], ARGV[a+6])
+			redis.call('EXPIREAT', KEYS[i*3+2], ARGV[a+5])
+		end
+		table.insert(result, ARGV[a+1])
+	end
+end
+return result
+`)
+
+// deleteScript marks the codes in ARGV deleted if they belong to the user
+// whose set is KEYS[1], and frees their original URLs. KEYS[2] and KEYS[3]
+// are the url: and orig: key prefixes.
+var deleteScript = goredis.NewScript(`
+for i = 1, #ARGV do
+	if redis.call('SISMEMBER', KEYS[1], ARGV[i]) == 1 then
+		local key = KEYS[2] .. ARGV[i]
+		local original = redis.call('HGET', key, 'original')
+		if original then
+			redis.call('HSET', key, 'deleted', '1')
+			local orig = KEYS[3] .. original
+			if redis.call('GET', orig) == ARGV[i] then
+				redis.call('DEL', orig)
+			end
+		end
+	end
+end
+return 0
+`)
+
+// clicksScript appends the click ARGV[i] to the list KEYS[2i] of the link
+// whose hash is KEYS[2i-1]. The list expires with the hash, and clicks of
+// links that are gone are dropped.
+var clicksScript = goredis.NewScript(`
+for i = 1, #ARGV do
+	local ttl = redis.call('PTTL', KEYS[i*2-1])
+	if ttl ~= -2 then
+		redis.call('RPUSH', KEYS[i*2], ARGV[i])
+		if ttl > 0 then
+			redis.call('PEXPIRE', KEYS[i*2], ttl)
+		end
+	end
+end
+return 0
+`)
+
+var errUnexpectedReply = errors.New("unexpected reply from redis")
+
+type Storage struct {
+	client *goredis.Client
+}
+
+// Connect opens a client for the Redis server at url, for example
+// redis://localhost:6379/0, and checks that the server answers.
+func Connect(url string) (*goredis.Client, error) {
+	opts, err := goredis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis url: %w", err)
+	}
+	client := goredis.NewClient(opts)
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to redis: %w", err)
+	}
+	return client, nil
+}
+
+func NewRedisStorage(url string) (*Storage, error) {
+	client, err := Connect(url)
+	if err != nil {
+		return nil, err
+	}
+	return New(client), nil
+}
+
+func New(client *goredis.Client) *Storage {
+	return &Storage{client: client}
+}
+
+// saveArgs returns the keys and arguments saveScript expects for one link.
+func saveArgs(userID, shortURL, originalURL string, expiresAt *time.Time) ([]string, []any) {
+	var expires, expireAt, purgeAt string
+	if expiresAt != nil {
+		expires = expiresAt.UTC().Format(time.RFC3339Nano)
+		// EXPIREAT takes whole seconds; round up so the key never outlives
+		// the link by less than it should.
+		expireAt = strconv.FormatInt(expiresAt.Add(time.Second-1).Unix(), 10)
+		purgeAt = strconv.FormatInt(expiresAt.Add(expiredGrace+time.Second-1).Unix(), 10)
+	}
+	return []string{urlKey(shortURL), origKey(originalURL), userKey(userID)},
+		[]any{shortURL, originalURL, userID, expires, expireAt, purgeAt}
+}
+
+func (s *Storage) SaveURL(ctx context.Context, userID string, url model.ShortenedURL) error {
+	keys, args := saveArgs(userID, url.ShortURL, url.OriginalURL, url.ExpiresAt)
+	res, err := saveScript.Run(ctx, s.client, keys, args...).Slice()
+	if err != nil {
+		return storage.Classify(err)
+	}
+	if len(res) != 2 {
+		return errUnexpectedReply
+	}
+	status, _ := res[0].(int64)
+	code, _ := res[1].(string)
+	switch status {
+	case 1:
+		return &storage.ConflictError{ShortURL: code}
+	case 2:
+		return &storage.TakenError{ShortURL: url.ShortURL}
+	}
+	return nil
+}
+
+func (s *Storage) SaveBatch(ctx context.Context, urls []model.DbSave) error {
+	if len(urls) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(urls)*3)
+	args := make([]any, 0, len(urls)*6)
+	for _, u := range urls {
+		k, a := saveArgs(u.UserID, u.Short_url, u.Original_url, u.ExpiresAt)
+		keys = append(keys, k...)
+		args = append(args, a...)
+	}
+	res, err := saveBatchScript.Run(ctx, s.client, keys, args...).StringSlice()
+	if err != nil {
+		return storage.Classify(err)
+	}
+	if res[0] == "taken" {
+		return &storage.TakenError{ShortURL: res[1]}
+	}
+	if len(res) != len(urls)+1 {
+		return errUnexpectedReply
+	}
+	conflict := false
+	for i, code := range res[1:] {
+		if code != urls[i].Short_url {
+			urls[i].Short_url = code
+			conflict = true
+		}
+	}
+	if conflict {
+		return storage.ErrURLExists
+	}
+	return nil
+}
+
+func (s *Storage) DeleteURLs(ctx context.Context, userID string, shortURLs []string) error {
+	if len(shortURLs) == 0 {
+		return nil
+	}
+	args := make([]any, len(shortURLs))
+	for i, shortURL := range shortURLs {
+		args[i] = shortURL
+	}
+	keys := []string{userKey(userID), keyPrefix + "url:", keyPrefix + "orig:"}
+	return storage.Classify(deleteScript.Run(ctx, s.client, keys, args...).Err())
+}
+
+// link reads the hash of shortURL. ok is false when there is no such link.
+func (s *Storage) link(ctx context.Context, shortURL string) (userID string, url model.ShortenedURL, ok bool, err error) {
+	fields, err := s.client.HGetAll(ctx, urlKey(shortURL)).Result()
+	if err != nil || len(fields) == 0 {
+		return "", url, false, storage.Classify(err)
+	}
+	url, err = parseLink(shortURL, fields)
+	return fields["user"], url, err == nil, err
+}
+
+func parseLink(shortURL string, fields map[string]string) (model.ShortenedURL, error) {
+	url := model.ShortenedURL{
+		ShortURL:    shortURL,
+		OriginalURL: fields["original"],
+		IsDeleted:   fields["deleted"] == "1",
+	}
+	if v := fields["expires_at"]; v != "" {
+		expiresAt, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return url, fmt.Errorf("corrupt expiry for %s: %w", shortURL, err)
+		}
+		url.ExpiresAt = &expiresAt
+	}
+	return url, nil
+}
+
+func (s *Storage) GetURLsByUser(ctx context.Context, userID string) ([]model.ShortenedURL, error) {
+	codes, err := s.client.SMembers(ctx, userKey(userID)).Result()
+	if err != nil {
+		return nil, storage.Classify(err)
+	}
+	sort.Strings(codes)
+	cmds := make([]*goredis.MapStringStringCmd, len(codes))
+	_, err = s.client.Pipelined(ctx, func(pipe goredis.Pipeliner) error {
+		for i, code := range codes {
+			cmds[i] = pipe.HGetAll(ctx, urlKey(code))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, storage.Classify(err)
+	}
+	now := time.Now()
+	var urls []model.ShortenedURL
+	var gone []any
+	for i, cmd := range cmds {
+		fields := cmd.Val()
+		// Purged links are dropped by Redis but stay in the user set.
+		if len(fields) == 0 {
+			gone = append(gone, codes[i])
+			continue
+		}
+		url, err := parseLink(codes[i], fields)
+		if err != nil {
+			return nil, err
+		}
+		if !url.IsDeleted && !url.Expired(now) {
+			urls = append(urls, url)
+		}
+	}
+	if len(gone) > 0 {
+		if err := s.client.SRem(ctx, userKey(userID), gone...).Err(); err != nil {
+			return nil, storage.Classify(err)
+		}
+	}
+	return urls, nil
+}
+
+func (s *Storage) FindUsersOrigURL(ctx context.Context, userID, shortURL string) (string, error) {
+	owner, url, ok, err := s.link(ctx, shortURL)
+	if err != nil {
+		return "", err
+	}
+	if !ok || owner != userID {
+		return "", storage.ErrNotFound
+	}
+	return url.OriginalURL, nil
+}
+
+func (s *Storage) FindOrigURL(ctx context.Context, shortURL string) (string, error) {
+	url, err := s.FindLink(ctx, shortURL)
+	return url.OriginalURL, err
+}
+
+func (s *Storage) FindLink(ctx context.Context, shortURL string) (model.ShortenedURL, error) {
+	_, url, ok, err := s.link(ctx, shortURL)
+	switch {
+	case err != nil:
+		return model.ShortenedURL{}, err
+	case !ok:
+		return model.ShortenedURL{}, storage.ErrNotFound
+	case url.IsDeleted:
+		return model.ShortenedURL{}, storage.ErrDeleted
+	case url.Expired(time.Now()):
+		return model.ShortenedURL{}, storage.ErrExpired
+	}
+	return url, nil
+}
+
+func (s *Storage) SaveClicks(ctx context.Context, clicks []model.Click) error {
+	if len(clicks) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(clicks)*2)
+	args := make([]any, 0, len(clicks))
+	for _, c := range clicks {
+		raw, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, urlKey(c.ShortURL), clicksKey(c.ShortURL))
+		args = append(args, raw)
+	}
+	return storage.Classify(clicksScript.Run(ctx, s.client, keys, args...).Err())
+}
+
+func (s *Storage) GetLinkStats(ctx context.Context, userID, shortURL string, bucket time.Duration) (model.LinkStats, error) {
+	owner, _, ok, err := s.link(ctx, shortURL)
+	if err != nil {
+		return model.LinkStats{}, err
+	}
+	if !ok || owner != userID {
+		return model.LinkStats{}, storage.ErrNotFound
+	}
+	raw, err := s.client.LRange(ctx, clicksKey(shortURL), 0, -1).Result()
+	if err != nil {
+		return model.LinkStats{}, storage.Classify(err)
+	}
+	stats := model.LinkStats{ShortURL: shortURL, Histogram: []model.StatsBucket{}}
+	visitors := make(map[string]struct{})
+	buckets := make(map[time.Time]int64)
+	for _, r := range raw {
+		var c model.Click
+		if err := json.Unmarshal([]byte(r), &c); err != nil {
+			return model.LinkStats{}, fmt.Errorf("corrupt click for %s: %w", shortURL, err)
+		}
+		stats.TotalClicks++
+		visitors[c.ClientIP+"|"+c.UserAgent] = struct{}{}
+		buckets[c.Timestamp.UTC().Truncate(bucket)]++
+	}
+	stats.UniqueVisitors = int64(len(visitors))
+	for start, clicks := range buckets {
+		stats.Histogram = append(stats.Histogram, model.StatsBucket{Start: start, Clicks: clicks})
+	}
+	sort.Slice(stats.Histogram, func(i, j int) bool {
+		return stats.Histogram[i].Start.Before(stats.Histogram[j].Start)
+	})
+	return stats, nil
+}
+
+// NextID makes the storage usable as a shortener.Sequence.
+func (s *Storage) NextID(ctx context.Context) (uint64, error) {
+	id, err := s.client.Incr(ctx, seqKey).Result()
+	return uint64(id), storage.Classify(err)
+}
+
+func (s *Storage) Ping(ctx context.Context) error {
+	return storage.Classify(s.client.Ping(ctx).Err())
+}
+
+func (s *Storage) Close() error {
+	return s.client.Close()
+}
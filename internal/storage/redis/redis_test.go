@@ -0,0 +1,157 @@
+package redis
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Polad20/urlshortener/internal/model"
+	"github.com/Polad20/urlshortener/internal/storage"
+	"github.com/Polad20/urlshortener/internal/storage/inmem"
+	"github.com/alicebob/miniredis/v2"
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestClient(t *testing.T) (*miniredis.Miniredis, *goredis.Client) {
+	mr := miniredis.RunT(t)
+	client := goredis.NewClient(&goredis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return mr, client
+}
+
+func TestStorage(t *testing.T) {
+	ctx := context.Background()
+	_, client := newTestClient(t)
+	s := New(client)
+
+	require.NoError(t, s.SaveURL(ctx, "user1", model.ShortenedURL{ShortURL: "aaa", OriginalURL: "https://a.example"}))
+	var conflict *storage.ConflictError
+	require.ErrorAs(t, s.SaveURL(ctx, "user2", model.ShortenedURL{ShortURL: "xxx", OriginalURL: "https://a.example"}), &conflict)
+	assert.Equal(t, "aaa", conflict.ShortURL)
+	assert.ErrorIs(t, s.SaveURL(ctx, "user2", model.ShortenedURL{ShortURL: "aaa", OriginalURL: "https://x.example"}), storage.ErrShortURLTaken)
+
+	batch := []model.DbSave{
+		{UserID: "user1", Short_url: "bbb", Original_url: "https://b.example"},
+		{UserID: "user1", Short_url: "ccc", Original_url: "https://a.example"},
+	}
+	assert.ErrorIs(t, s.SaveBatch(ctx, batch), storage.ErrURLExists)
+	assert.Equal(t, "aaa", batch[1].Short_url)
+	err := s.SaveBatch(ctx, []model.DbSave{
+		{UserID: "user1", Short_url: "ddd", Original_url: "https://d.example"},
+		{UserID: "user1", Short_url: "bbb", Original_url: "https://e.example"},
+	})
+	assert.ErrorIs(t, err, storage.ErrShortURLTaken)
+	_, err = s.FindOrigURL(ctx, "ddd")
+	assert.ErrorIs(t, err, storage.ErrNotFound, "a failed batch must not be partially saved")
+
+	require.NoError(t, s.DeleteURLs(ctx, "user2", []string{"aaa"}))
+	require.NoError(t, s.DeleteURLs(ctx, "user1", []string{"bbb"}))
+	orig, err := s.FindOrigURL(ctx, "aaa")
+	require.NoError(t, err)
+	assert.Equal(t, "https://a.example", orig)
+	_, err = s.FindOrigURL(ctx, "bbb")
+	assert.ErrorIs(t, err, storage.ErrDeleted)
+	urls, err := s.GetURLsByUser(ctx, "user1")
+	require.NoError(t, err)
+	require.Len(t, urls, 1)
+	assert.Equal(t, "aaa", urls[0].ShortURL)
+
+	require.NoError(t, s.SaveURL(ctx, "user2", model.ShortenedURL{ShortURL: "ggg", OriginalURL: "https://b.example"}),
+		"a deleted original URL can be shortened again")
+	_, err = s.FindOrigURL(ctx, "bbb")
+	assert.ErrorIs(t, err, storage.ErrDeleted)
+}
+
+func TestExpiry(t *testing.T) {
+	ctx := context.Background()
+	mr, client := newTestClient(t)
+	s := New(client)
+	// miniredis only moves key TTLs with FastForward, so the link expires
+	// against the real clock while Redis still holds its keys.
+	expiresAt := time.Now().Add(10 * time.Millisecond)
+	require.NoError(t, s.SaveURL(ctx, "user1", model.ShortenedURL{ShortURL: "eee", OriginalURL: "https://e.example", ExpiresAt: &expiresAt}))
+	require.NoError(t, s.SaveClicks(ctx, []model.Click{{ShortURL: "eee", Timestamp: time.Now()}, {ShortURL: "gone", Timestamp: time.Now()}}))
+	assert.True(t, mr.TTL(urlKey("eee")) > mr.TTL(origKey("https://e.example")))
+	assert.InDelta(t, mr.TTL(urlKey("eee")), mr.TTL(clicksKey("eee")), float64(time.Millisecond), "clicks expire with their link")
+	assert.False(t, mr.Exists(clicksKey("gone")), "clicks of unknown links are dropped")
+
+	time.Sleep(time.Until(expiresAt))
+	mr.FastForward(2 * time.Second)
+	_, err := s.FindOrigURL(ctx, "eee")
+	assert.ErrorIs(t, err, storage.ErrExpired)
+	urls, err := s.GetURLsByUser(ctx, "user1")
+	require.NoError(t, err)
+	assert.Empty(t, urls)
+	require.NoError(t, s.SaveURL(ctx, "user2", model.ShortenedURL{ShortURL: "fff", OriginalURL: "https://e.example"}),
+		"an expired original URL can be shortened again")
+
+	mr.FastForward(expiredGrace)
+	_, err = s.FindOrigURL(ctx, "eee")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	assert.False(t, mr.Exists(clicksKey("eee")))
+	_, err = s.GetURLsByUser(ctx, "user1")
+	require.NoError(t, err)
+	assert.False(t, mr.Exists(userKey("user1")), "purged codes are pruned from the user set")
+}
+
+func TestLinkStats(t *testing.T) {
+	ctx := context.Background()
+	_, client := newTestClient(t)
+	s := New(client)
+	require.NoError(t, s.SaveURL(ctx, "user1", model.ShortenedURL{ShortURL: "aaa", OriginalURL: "https://a.example"}))
+	now := time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC)
+	require.NoError(t, s.SaveClicks(ctx, []model.Click{
+		{ShortURL: "aaa", Timestamp: now, ClientIP: "10.0.0.0", UserAgent: "a"},
+		{ShortURL: "aaa", Timestamp: now.Add(time.Hour), ClientIP: "10.0.1.0", UserAgent: "a"},
+	}))
+	stats, err := s.GetLinkStats(ctx, "user1", "aaa", time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), stats.TotalClicks)
+	assert.Equal(t, int64(2), stats.UniqueVisitors)
+	assert.Len(t, stats.Histogram, 2)
+	_, err = s.GetLinkStats(ctx, "user2", "aaa", time.Hour)
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+}
+
+func TestCache(t *testing.T) {
+	ctx := context.Background()
+	mr, client := newTestClient(t)
+	primary := inmem.NewInmem()
+	c := NewCache(primary, client, time.Minute)
+
+	require.NoError(t, c.SaveURL(ctx, "user1", model.ShortenedURL{ShortURL: "aaa", OriginalURL: "https://a.example"}))
+	orig, err := c.FindOrigURL(ctx, "aaa")
+	require.NoError(t, err)
+	assert.Equal(t, "https://a.example", orig)
+	assert.True(t, mr.Exists(cacheKey("aaa")))
+
+	_, err = c.FindOrigURL(ctx, "zzz")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	assert.False(t, mr.Exists(cacheKey("zzz")))
+
+	expiresAt := time.Now().Add(10 * time.Second)
+	require.NoError(t, c.SaveURL(ctx, "user1", model.ShortenedURL{ShortURL: "bbb", OriginalURL: "https://b.example", ExpiresAt: &expiresAt}))
+	_, err = c.FindOrigURL(ctx, "bbb")
+	require.NoError(t, err)
+	assert.LessOrEqual(t, mr.TTL(cacheKey("bbb")), 10*time.Second, "cached links expire with the link")
+
+	require.NoError(t, c.DeleteURLs(ctx, "user1", []string{"aaa"}))
+	assert.False(t, mr.Exists(cacheKey("aaa")))
+	_, err = c.FindOrigURL(ctx, "aaa")
+	assert.ErrorIs(t, err, storage.ErrDeleted)
+}
+
+func TestCacheDeleteWithRedisDown(t *testing.T) {
+	ctx := context.Background()
+	mr, client := newTestClient(t)
+	primary := inmem.NewInmem()
+	c := NewCache(primary, client, time.Minute)
+
+	require.NoError(t, c.SaveURL(ctx, "user1", model.ShortenedURL{ShortURL: "aaa", OriginalURL: "https://a.example"}))
+	mr.Close()
+	require.NoError(t, c.DeleteURLs(ctx, "user1", []string{"aaa"}), "the primary committed the delete")
+	_, err := primary.FindOrigURL(ctx, "aaa")
+	assert.ErrorIs(t, err, storage.ErrDeleted)
+}
@@ -2,13 +2,26 @@ package storage
 
 import (
 	"context"
+	"time"
 
 	"github.com/Polad20/urlshortener/internal/model"
 )
 
+// Storage keeps shortened URLs. SaveURL returns a *ConflictError when the
+// original URL is already stored; SaveBatch stores what it can, replaces the
+// short URL of already stored entries in place and returns ErrURLExists.
+// FindLink is FindOrigURL returning the whole link, so that caches can tell
+// when it expires.
 type Storage interface {
-	SaveURL(userID, shortURL, originalURL string) error
-	GetURLsByUser(userID string) ([]model.ShortenedURL, error)
+	SaveURL(ctx context.Context, userID string, url model.ShortenedURL) error
+	GetURLsByUser(ctx context.Context, userID string) ([]model.ShortenedURL, error)
 	Ping(ctx context.Context) error
-	FindUsersOrigURL(userID, shortURL string) (string, error)
+	FindUsersOrigURL(ctx context.Context, userID, shortURL string) (string, error)
+	FindOrigURL(ctx context.Context, shortURL string) (string, error)
+	FindLink(ctx context.Context, shortURL string) (model.ShortenedURL, error)
+	SaveBatch(ctx context.Context, urls []model.DbSave) error
+	DeleteURLs(ctx context.Context, userID string, shortURLs []string) error
+	SaveClicks(ctx context.Context, clicks []model.Click) error
+	GetLinkStats(ctx context.Context, userID, shortURL string, bucket time.Duration) (model.LinkStats, error)
+	Close() error
 }
@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/Polad20/urlshortener/internal/model"
+)
+
+// Timeouts bounds how long each kind of storage call may take. A zero
+// duration leaves the caller's context as is.
+type Timeouts struct {
+	// Redirect applies to FindOrigURL and FindLink, the hot path of every
+	// redirect.
+	Redirect time.Duration
+	// Read applies to GetURLsByUser and FindUsersOrigURL.
+	Read time.Duration
+	// Write applies to SaveURL, SaveBatch, DeleteURLs, SaveClicks and
+	// PurgeExpired.
+	Write time.Duration
+	// Stats applies to GetLinkStats.
+	Stats time.Duration
+	Ping  time.Duration
+}
+
+type timeoutStorage struct {
+	Storage
+	timeouts Timeouts
+}
+
+// WithTimeouts wraps s so that every call gets a deadline from t. The
+// result still implements Reaper when s does.
+func WithTimeouts(s Storage, t Timeouts) Storage {
+	ts := &timeoutStorage{Storage: s, timeouts: t}
+	if _, ok := s.(Reaper); ok {
+		return &timeoutReaper{ts}
+	}
+	return ts
+}
+
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+func (s *timeoutStorage) SaveURL(ctx context.Context, userID string, url model.ShortenedURL) error {
+	ctx, cancel := withTimeout(ctx, s.timeouts.Write)
+	defer cancel()
+	return s.Storage.SaveURL(ctx, userID, url)
+}
+
+func (s *timeoutStorage) GetURLsByUser(ctx context.Context, userID string) ([]model.ShortenedURL, error) {
+	ctx, cancel := withTimeout(ctx, s.timeouts.Read)
+	defer cancel()
+	return s.Storage.GetURLsByUser(ctx, userID)
+}
+
+func (s *timeoutStorage) Ping(ctx context.Context) error {
+	ctx, cancel := withTimeout(ctx, s.timeouts.Ping)
+	defer cancel()
+	return s.Storage.Ping(ctx)
+}
+
+func (s *timeoutStorage) FindUsersOrigURL(ctx context.Context, userID, shortURL string) (string, error) {
+	ctx, cancel := withTimeout(ctx, s.timeouts.Read)
+	defer cancel()
+	return s.Storage.FindUsersOrigURL(ctx, userID, shortURL)
+}
+
+func (s *timeoutStorage) FindOrigURL(ctx context.Context, shortURL string) (string, error) {
+	ctx, cancel := withTimeout(ctx, s.timeouts.Redirect)
+	defer cancel()
+	return s.Storage.FindOrigURL(ctx, shortURL)
+}
+
+func (s *timeoutStorage) FindLink(ctx context.Context, shortURL string) (model.ShortenedURL, error) {
+	ctx, cancel := withTimeout(ctx, s.timeouts.Redirect)
+	defer cancel()
+	return s.Storage.FindLink(ctx, shortURL)
+}
+
+func (s *timeoutStorage) SaveBatch(ctx context.Context, urls []model.DbSave) error {
+	ctx, cancel := withTimeout(ctx, s.timeouts.Write)
+	defer cancel()
+	return s.Storage.SaveBatch(ctx, urls)
+}
+
+func (s *timeoutStorage) DeleteURLs(ctx context.Context, userID string, shortURLs []string) error {
+	ctx, cancel := withTimeout(ctx, s.timeouts.Write)
+	defer cancel()
+	return s.Storage.DeleteURLs(ctx, userID, shortURLs)
+}
+
+func (s *timeoutStorage) SaveClicks(ctx context.Context, clicks []model.Click) error {
+	ctx, cancel := withTimeout(ctx, s.timeouts.Write)
+	defer cancel()
+	return s.Storage.SaveClicks(ctx, clicks)
+}
+
+func (s *timeoutStorage) GetLinkStats(ctx context.Context, userID, shortURL string, bucket time.Duration) (model.LinkStats, error) {
+	ctx, cancel := withTimeout(ctx, s.timeouts.Stats)
+	defer cancel()
+	return s.Storage.GetLinkStats(ctx, userID, shortURL, bucket)
+}
+
+type timeoutReaper struct {
+	*timeoutStorage
+}
+
+func (s *timeoutReaper) PurgeExpired(ctx context.Context) (int64, error) {
+	ctx, cancel := withTimeout(ctx, s.timeouts.Write)
+	defer cancel()
+	return s.Storage.(Reaper).PurgeExpired(ctx)
+}
@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Polad20/urlshortener/internal/model"
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingStorage waits for the context of every FindOrigURL call to end.
+type blockingStorage struct {
+	Storage
+}
+
+func (blockingStorage) FindOrigURL(ctx context.Context, shortURL string) (string, error) {
+	<-ctx.Done()
+	return "", ctx.Err()
+}
+
+func (blockingStorage) PurgeExpired(ctx context.Context) (int64, error) {
+	return 0, nil
+}
+
+func (blockingStorage) SaveURL(ctx context.Context, userID string, url model.ShortenedURL) error {
+	if _, ok := ctx.Deadline(); ok {
+		return context.DeadlineExceeded
+	}
+	return nil
+}
+
+func TestWithTimeouts(t *testing.T) {
+	s := WithTimeouts(blockingStorage{}, Timeouts{Redirect: 10 * time.Millisecond})
+	start := time.Now()
+	_, err := s.FindOrigURL(context.Background(), "abc")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+
+	assert.NoError(t, s.SaveURL(context.Background(), "user", model.ShortenedURL{}), "zero timeout sets no deadline")
+
+	_, ok := s.(Reaper)
+	assert.True(t, ok, "wrapping keeps the Reaper")
+}
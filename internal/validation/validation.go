@@ -0,0 +1,367 @@
+package validation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/idna"
+)
+
+var (
+	ErrInvalidURL = errors.New("invalid URL")
+	// ErrForbiddenDestination is returned for well-formed URLs that point
+	// somewhere the service must not redirect to.
+	ErrForbiddenDestination = errors.New("destination not allowed")
+)
+
+const (
+	// TrailingSlashKeep leaves paths as they are.
+	TrailingSlashKeep = "keep"
+	// TrailingSlashStrip drops the trailing slash of every path but the
+	// root, so /docs/ and /docs are the same link.
+	TrailingSlashStrip = "strip"
+)
+
+type Options struct {
+	// Schemes are the allowed URL schemes, http and https by default.
+	Schemes []string
+	// MaxLength bounds the length of the URL as submitted, 2048 by default.
+	MaxLength int
+	// TrailingSlash is TrailingSlashKeep (default) or TrailingSlashStrip.
+	TrailingSlash string
+	// SortQuery orders query parameters by name, so ?a=1&b=2 and ?b=2&a=1
+	// are the same link. Values of a repeated parameter keep their order.
+	SortQuery bool
+
+	// BlockPrivate rejects loopback, private, link-local and other
+	// non-public addresses, given literally or, with a Resolver, after
+	// resolving the host name.
+	BlockPrivate bool
+	// Resolver looks up host names for BlockPrivate. Nil checks only
+	// literal addresses and localhost names.
+	Resolver Resolver
+	// ResolveTimeout bounds a lookup, and all lookups of a ValidateBatch
+	// together, 2s by default.
+	ResolveTimeout time.Duration
+	// OwnHosts are the host names the service itself answers on; links to
+	// them would redirect back into the shortener.
+	OwnHosts []string
+	// Shorteners are domains of other URL shorteners. Their subdomains are
+	// rejected too.
+	Shorteners []string
+}
+
+// Resolver is the part of net.Resolver the validator needs.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+	"ftp":   "21",
+}
+
+// Validator checks submitted URLs and brings them into the canonical form
+// under which they are stored, so that duplicates are found regardless of
+// spelling.
+type Validator struct {
+	schemes       map[string]struct{}
+	maxLength     int
+	trailingSlash string
+	sortQuery     bool
+
+	blockPrivate   bool
+	resolver       Resolver
+	resolveTimeout time.Duration
+	ownHosts       map[string]struct{}
+	shorteners     map[string]struct{}
+}
+
+func New(opts Options) (*Validator, error) {
+	if len(opts.Schemes) == 0 {
+		opts.Schemes = []string{"http", "https"}
+	}
+	if opts.MaxLength <= 0 {
+		opts.MaxLength = 2048
+	}
+	switch opts.TrailingSlash {
+	case "":
+		opts.TrailingSlash = TrailingSlashKeep
+	case TrailingSlashKeep, TrailingSlashStrip:
+	default:
+		return nil, fmt.Errorf("unknown trailing slash rule %q", opts.TrailingSlash)
+	}
+	if opts.ResolveTimeout <= 0 {
+		opts.ResolveTimeout = 2 * time.Second
+	}
+	v := &Validator{
+		schemes:        make(map[string]struct{}, len(opts.Schemes)),
+		maxLength:      opts.MaxLength,
+		trailingSlash:  opts.TrailingSlash,
+		sortQuery:      opts.SortQuery,
+		blockPrivate:   opts.BlockPrivate,
+		resolver:       opts.Resolver,
+		resolveTimeout: opts.ResolveTimeout,
+	}
+	for _, scheme := range opts.Schemes {
+		if scheme = strings.ToLower(strings.TrimSpace(scheme)); scheme != "" {
+			v.schemes[scheme] = struct{}{}
+		}
+	}
+	var err error
+	if v.ownHosts, err = hostSet(opts.OwnHosts); err != nil {
+		return nil, err
+	}
+	if v.shorteners, err = hostSet(opts.Shorteners); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func hostSet(hosts []string) (map[string]struct{}, error) {
+	set := make(map[string]struct{}, len(hosts))
+	for _, host := range hosts {
+		if host = strings.TrimSpace(host); host == "" {
+			continue
+		}
+		normalized, err := normalizeHost(host)
+		if err != nil {
+			return nil, err
+		}
+		set[normalized] = struct{}{}
+	}
+	return set, nil
+}
+
+// Validate normalizes raw and checks that the result is a destination the
+// service may redirect to.
+func (v *Validator) Validate(ctx context.Context, raw string) (string, error) {
+	normalized, err := v.Normalize(raw)
+	if err != nil {
+		return "", err
+	}
+	if err := v.CheckDestination(ctx, normalized); err != nil {
+		return "", err
+	}
+	return normalized, nil
+}
+
+// batchLookups bounds how many host lookups a ValidateBatch runs at once.
+const batchLookups = 16
+
+// ValidateBatch is Validate for every URL of a batch, returning the
+// normalized URLs and an error per URL. The destinations are checked
+// concurrently under a single ResolveTimeout, so a batch takes about as long
+// as one URL; lookups cut short by it are treated like failed ones.
+func (v *Validator) ValidateBatch(ctx context.Context, raws []string) ([]string, []error) {
+	normalized := make([]string, len(raws))
+	errs := make([]error, len(raws))
+	for i, raw := range raws {
+		normalized[i], errs[i] = v.Normalize(raw)
+	}
+	ctx, cancel := context.WithTimeout(ctx, v.resolveTimeout)
+	defer cancel()
+	sem := make(chan struct{}, batchLookups)
+	var wg sync.WaitGroup
+	for i := range raws {
+		if errs[i] != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			errs[i] = v.CheckDestination(ctx, normalized[i])
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			normalized[i] = ""
+		}
+	}
+	return normalized, errs
+}
+
+// CheckDestination rejects normalized URLs that point back at the service,
+// at another shortener or, with BlockPrivate, at a non-public address.
+// Lookup failures are not treated as rejections: a name that does not
+// resolve cannot be reached either.
+func (v *Validator) CheckDestination(ctx context.Context, normalized string) error {
+	u, err := url.Parse(normalized)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidURL, err)
+	}
+	host := u.Hostname()
+	if _, ok := v.ownHosts[host]; ok {
+		return fmt.Errorf("%w: links to this service would redirect to themselves", ErrForbiddenDestination)
+	}
+	if matchDomain(v.shorteners, host) {
+		return fmt.Errorf("%w: %s is a URL shortener", ErrForbiddenDestination, host)
+	}
+	if !v.blockPrivate {
+		return nil
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if !public(ip) {
+			return fmt.Errorf("%w: %s is not a public address", ErrForbiddenDestination, host)
+		}
+		return nil
+	}
+	if numericHost(host) {
+		// Browsers read hosts like 2130706433 or 0x7f.1 as IPv4 addresses.
+		return fmt.Errorf("%w: %s looks like an address in non-standard notation", ErrForbiddenDestination, host)
+	}
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return fmt.Errorf("%w: %s is not a public address", ErrForbiddenDestination, host)
+	}
+	if v.resolver == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, v.resolveTimeout)
+	defer cancel()
+	addrs, err := v.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		ip, ok := netip.AddrFromSlice(addr.IP)
+		if ok && !public(ip) {
+			return fmt.Errorf("%w: %s resolves to %s", ErrForbiddenDestination, host, ip.Unmap())
+		}
+	}
+	return nil
+}
+
+func matchDomain(domains map[string]struct{}, host string) bool {
+	for {
+		if _, ok := domains[host]; ok {
+			return true
+		}
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			return false
+		}
+		host = host[i+1:]
+	}
+}
+
+func numericHost(host string) bool {
+	last := host[strings.LastIndexByte(host, '.')+1:]
+	if strings.HasPrefix(last, "0x") {
+		return true
+	}
+	_, err := strconv.ParseUint(last, 10, 64)
+	return err == nil
+}
+
+// sharedAddressSpace is the carrier-grade NAT range of RFC 6598, which
+// netip does not count as private.
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+func public(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !sharedAddressSpace.Contains(ip)
+}
+
+// Normalize validates raw and returns its canonical form: scheme and host
+// lower-cased, internationalized host names in punycode, default ports
+// dropped, an empty path turned into / and the trailing slash and query
+// rules of the options applied.
+func (v *Validator) Normalize(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", fmt.Errorf("%w: empty", ErrInvalidURL)
+	}
+	if len(raw) > v.maxLength {
+		return "", fmt.Errorf("%w: longer than %d characters", ErrInvalidURL, v.maxLength)
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidURL, err)
+	}
+	if !u.IsAbs() {
+		return "", fmt.Errorf("%w: must be absolute", ErrInvalidURL)
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	if _, ok := v.schemes[u.Scheme]; !ok {
+		return "", fmt.Errorf("%w: scheme %q is not allowed", ErrInvalidURL, u.Scheme)
+	}
+	if u.Opaque != "" || u.Host == "" {
+		return "", fmt.Errorf("%w: missing host", ErrInvalidURL)
+	}
+	if u.User != nil {
+		return "", fmt.Errorf("%w: credentials are not allowed", ErrInvalidURL)
+	}
+	host, err := normalizeHost(u.Hostname())
+	if err != nil {
+		return "", err
+	}
+	port := u.Port()
+	if port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return "", fmt.Errorf("%w: bad port %q", ErrInvalidURL, port)
+		}
+		if defaultPorts[u.Scheme] == port {
+			port = ""
+		}
+	}
+	if port != "" {
+		u.Host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		u.Host = "[" + host + "]"
+	} else {
+		u.Host = host
+	}
+	if u.Path == "" {
+		u.Path = "/"
+		u.RawPath = ""
+	}
+	if v.trailingSlash == TrailingSlashStrip && len(u.Path) > 1 && strings.HasSuffix(u.Path, "/") {
+		u.Path = strings.TrimRight(u.Path, "/")
+		if u.Path == "" {
+			u.Path = "/"
+		}
+		u.RawPath = ""
+	}
+	if v.sortQuery && u.RawQuery != "" {
+		u.RawQuery = sortQuery(u.RawQuery)
+	}
+	u.ForceQuery = false
+	return u.String(), nil
+}
+
+// sortQuery orders the k=v segments of a raw query by their raw key. The
+// segments are not decoded, so ?flag, + and %20 and other encodings the
+// destination may tell apart survive as they are.
+func sortQuery(raw string) string {
+	segments := strings.Split(raw, "&")
+	sort.SliceStable(segments, func(i, j int) bool {
+		ki, _, _ := strings.Cut(segments[i], "=")
+		kj, _, _ := strings.Cut(segments[j], "=")
+		return ki < kj
+	})
+	return strings.Join(segments, "&")
+}
+
+func normalizeHost(host string) (string, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String(), nil
+	}
+	ascii, err := idna.Lookup.ToASCII(strings.TrimSuffix(host, "."))
+	if err != nil || ascii == "" {
+		return "", fmt.Errorf("%w: bad host %q", ErrInvalidURL, host)
+	}
+	return strings.ToLower(ascii), nil
+}